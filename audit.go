@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	klog "k8s.io/klog/v2"
+)
+
+// Formats kove audit may write its report in, alongside formatJSON
+const (
+	formatCSV      = "csv"
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+)
+
+// auditPageSize is the number of objects requested at a time when listing
+const auditPageSize = 500
+
+// auditReport summarises the violations found in a cluster
+type auditReport struct {
+	Generated  time.Time
+	Objects    int
+	Violations []evalResult
+
+	ByNamespace []auditCount
+	ByKind      []auditCount
+	ByRuleset   []auditCount
+
+	// Resources that couldn't be listed, and so weren't audited
+	Unlisted []string
+}
+
+// auditCount is the number of violations sharing a namespace, kind or ruleset
+type auditCount struct {
+	Name       string
+	Violations int
+}
+
+// auditCommand lists every watched object once, evaluates it and writes a report of the
+// violations found, exiting with exitViolations if there are any
+func auditCommand(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	path := fs.String("config", "", "Path to the configuration")
+	output := fs.String("output", formatJSON, "Format to write the report in: json, csv, markdown or html")
+	reportPath := fs.String("report", "", "Path to write the report to. If not set, it's written to stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kove audit [options]\n\nEvaluates every watched object in the cluster once and reports the violations found.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+
+	if !contains([]string{formatJSON, formatCSV, formatMarkdown, formatHTML}, *output) {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		return exitError
+	}
+	if err := setupCommand(*path); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	c := conf.Load()
+
+	cfg, err := restConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to retrieve kube config: %v\n", err)
+		return exitError
+	}
+	dc, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to construct kube config: %v\n", err)
+		return exitError
+	}
+	discover, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to construct discovery client: %v\n", err)
+		return exitError
+	}
+
+	report, err := auditCluster(context.Background(), dc, c, objectsToWatch(c, discover))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	w := io.Writer(os.Stdout)
+	if *reportPath != "" {
+		f, err := os.Create(*reportPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to create report: %v\n", err)
+			return exitError
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeReport(w, *output, report); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to write report: %v\n", err)
+		return exitError
+	}
+
+	switch {
+	case len(report.Violations) > 0:
+		return exitViolations
+	case len(report.Unlisted) > 0:
+		return exitError
+	}
+	return exitOK
+}
+
+// auditCluster lists the objects we'd watch in the cluster, applying the same filters as
+// when watching, evaluates each and summarises the violations found
+func auditCluster(ctx context.Context, dc dynamic.Interface, c *config, toWatch []objectConfig) (*auditReport, error) {
+	// Objects are only audited in namespaces currently matching the selector
+	if c.NamespaceSelector != "" {
+		namespaces, err := dc.Resource(namespacesGVR).List(ctx, metav1.ListOptions{LabelSelector: c.NamespaceSelector})
+		if err != nil {
+			return nil, fmt.Errorf("unable to list namespaces: %w", err)
+		}
+		for _, ns := range namespaces.Items {
+			selectedNamespaces.set(ns.GetName(), true)
+		}
+	}
+
+	report := &auditReport{Generated: time.Now().UTC()}
+	var evaluations []evaluation
+	for _, ns := range informerNamespaces(c) {
+		for _, o := range toWatch {
+			gvr := o.GroupVersionResource
+			opts := metav1.ListOptions{Limit: auditPageSize}
+			o.tweakListOptions(&opts)
+			for {
+				list, err := dc.Resource(gvr).Namespace(ns).List(ctx, opts)
+				if err != nil {
+					klog.ErrorS(err, "unable to list objects", "resource", informerName(gvr, ns))
+					report.Unlisted = append(report.Unlisted, informerName(gvr, ns))
+					break
+				}
+
+				for i := range list.Items {
+					obj := &list.Items[i]
+					if (c.IgnoreChildren && hasOwnerRefs(obj)) || !watchingNamespace(c, obj.GetNamespace()) {
+						continue
+					}
+					found, err := evaluateObject(ctx, policies, gvr, obj)
+					if err != nil {
+						return nil, fmt.Errorf("unable to evaluate %s %s: %w", obj.GetKind(), objectName(obj.GetNamespace(), obj.GetName()), err)
+					}
+					evaluations = append(evaluations, evaluation{manifest: manifest{source: gvr.String(), obj: obj}, found: found})
+				}
+
+				if list.GetContinue() == "" {
+					break
+				}
+				opts.Continue = list.GetContinue()
+			}
+		}
+	}
+
+	report.Objects = len(evaluations)
+	report.Violations = results(evaluations)
+	report.ByNamespace = countViolations(report.Violations, func(r evalResult) string { return r.Namespace })
+	report.ByKind = countViolations(report.Violations, func(r evalResult) string { return r.Kind })
+	report.ByRuleset = countViolations(report.Violations, func(r evalResult) string { return r.RuleSet })
+	return report, nil
+}
+
+// countViolations counts violations by the given key, most violations first
+func countViolations(violations []evalResult, key func(evalResult) string) []auditCount {
+	counts := make(map[string]int)
+	for _, v := range violations {
+		counts[key(v)]++
+	}
+
+	summary := []auditCount{}
+	for name, n := range counts {
+		summary = append(summary, auditCount{Name: name, Violations: n})
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].Violations != summary[j].Violations {
+			return summary[i].Violations > summary[j].Violations
+		}
+		return summary[i].Name < summary[j].Name
+	})
+	return summary
+}
+
+// writeReport writes an audit report in the given format
+func writeReport(w io.Writer, format string, report *auditReport) error {
+	switch format {
+	case formatCSV:
+		return writeCSVReport(w, report)
+	case formatMarkdown:
+		return markdownReport.Execute(w, report)
+	case formatHTML:
+		return htmlReport.Execute(w, report)
+	default:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+}
+
+// writeCSVReport writes a row for each violation, from which summaries can be pivoted
+func writeCSVReport(w io.Writer, report *auditReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"namespace", "kind", "name", "api_version", "query", "ruleset", "severity", "data"})
+	for _, v := range report.Violations {
+		cw.Write([]string{v.Namespace, v.Kind, v.Name, v.ApiVersion, v.Query, v.RuleSet, v.Severity, v.Data})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// markdownCell escapes a value for a Markdown table cell
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
+
+var markdownReport = template.Must(template.New("markdown").Funcs(template.FuncMap{"cell": markdownCell}).Parse(`# kove audit
+
+Generated {{ .Generated.Format "2006-01-02 15:04:05 MST" }}: {{ len .Violations }} violation(s) found in {{ .Objects }} object(s).
+{{- if .Unlisted }}
+
+The following resources couldn't be listed, and weren't audited:
+{{ range .Unlisted }}
+- {{ . }}
+{{- end }}
+{{- end }}
+{{- if .Violations }}
+
+## By namespace
+| Namespace | Violations |
+|:----------|-----------:|
+{{- range .ByNamespace }}
+| {{ cell .Name }} | {{ .Violations }} |
+{{- end }}
+
+## By kind
+| Kind | Violations |
+|:-----|-----------:|
+{{- range .ByKind }}
+| {{ cell .Name }} | {{ .Violations }} |
+{{- end }}
+
+## By ruleset
+| Ruleset | Violations |
+|:--------|-----------:|
+{{- range .ByRuleset }}
+| {{ cell .Name }} | {{ .Violations }} |
+{{- end }}
+
+## Violations
+| Namespace | Kind | Name | Query | Ruleset | Severity | Data |
+|:----------|:-----|:-----|:------|:--------|:---------|:-----|
+{{- range .Violations }}
+| {{ cell .Namespace }} | {{ cell .Kind }} | {{ cell .Name }} | {{ cell .Query }} | {{ cell .RuleSet }} | {{ cell .Severity }} | {{ cell .Data }} |
+{{- end }}
+{{- end }}
+`))
+
+var htmlReport = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>kove audit</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.5em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>kove audit</h1>
+<p>Generated {{ .Generated.Format "2006-01-02 15:04:05 MST" }}: {{ len .Violations }} violation(s) found in {{ .Objects }} object(s).</p>
+{{- if .Unlisted }}
+<p>The following resources couldn't be listed, and weren't audited:</p>
+<ul>
+{{- range .Unlisted }}
+<li>{{ . }}</li>
+{{- end }}
+</ul>
+{{- end }}
+{{- if .Violations }}
+<h2>By namespace</h2>
+<table>
+<tr><th>Namespace</th><th>Violations</th></tr>
+{{- range .ByNamespace }}
+<tr><td>{{ .Name }}</td><td>{{ .Violations }}</td></tr>
+{{- end }}
+</table>
+<h2>By kind</h2>
+<table>
+<tr><th>Kind</th><th>Violations</th></tr>
+{{- range .ByKind }}
+<tr><td>{{ .Name }}</td><td>{{ .Violations }}</td></tr>
+{{- end }}
+</table>
+<h2>By ruleset</h2>
+<table>
+<tr><th>Ruleset</th><th>Violations</th></tr>
+{{- range .ByRuleset }}
+<tr><td>{{ .Name }}</td><td>{{ .Violations }}</td></tr>
+{{- end }}
+</table>
+<h2>Violations</h2>
+<table>
+<tr><th>Namespace</th><th>Kind</th><th>Name</th><th>Query</th><th>Ruleset</th><th>Severity</th><th>Data</th></tr>
+{{- range .Violations }}
+<tr><td>{{ .Namespace }}</td><td>{{ .Kind }}</td><td>{{ .Name }}</td><td>{{ .Query }}</td><td>{{ .RuleSet }}</td><td>{{ .Severity }}</td><td>{{ .Data }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+</body>
+</html>
+`))
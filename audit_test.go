@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestAuditCluster(t *testing.T) {
+	initConfig()
+
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	services := schema.GroupVersionResource{Version: "v1", Resource: "services"}
+	var objects []runtime.Object
+	for _, obj := range []*unstructured.Unstructured{
+		newUnstructured("apps/v1", "Deployment", "payments", "old", "1", annotationsTeam, getChartLabels("3.0.0"), false),
+		newUnstructured("apps/v1", "Deployment", "search", "old", "1", annotationsTeam, getChartLabels("3.0.0"), false),
+		newUnstructured("apps/v1", "Deployment", "search", "current", "1", annotationsTeam, getChartLabels("3.0.2"), false),
+		newUnstructured("apps/v1", "Deployment", "search", "child", "1", annotationsTeam, getChartLabels("3.0.0"), true),
+	} {
+		// The fake client deep copies objects, which needs them to hold JSON values
+		b, err := json.Marshal(obj.Object)
+		require.NoError(t, err)
+		u := &unstructured.Unstructured{}
+		require.NoError(t, u.UnmarshalJSON(b))
+		objects = append(objects, u)
+	}
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{deployments: "DeploymentList", services: "ServiceList"},
+		objects...,
+	)
+
+	c := *conf.Load()
+	c.IgnoreChildren = true
+	c.ExcludeNamespaces = []string{"payments"}
+	report, err := auditCluster(context.Background(), dc, &c, []objectConfig{{GroupVersionResource: deployments}, {GroupVersionResource: services}})
+	require.NoError(t, err)
+
+	// Children and objects in excluded namespaces aren't audited
+	require.Equal(t, 2, report.Objects)
+	require.Len(t, report.Violations, 1)
+	require.Equal(t, []auditCount{{Name: "search", Violations: 1}}, report.ByNamespace)
+	require.Equal(t, []auditCount{{Name: "Deployment", Violations: 1}}, report.ByKind)
+	require.Empty(t, report.Unlisted)
+}
+
+func TestWriteReport(t *testing.T) {
+	report := &auditReport{
+		Objects: 2,
+		Violations: []evalResult{
+			{Query: "default", Violation: Violation{Name: "a", Namespace: "test", Kind: "Deployment", RuleSet: "bad | worse", Data: "<script>"}},
+			{Query: "default", Violation: Violation{Name: "b", Namespace: "test", Kind: "Deployment", RuleSet: "bad | worse"}},
+		},
+		ByNamespace: []auditCount{{Name: "test", Violations: 2}},
+		ByKind:      []auditCount{{Name: "Deployment", Violations: 2}},
+		ByRuleset:   []auditCount{{Name: "bad | worse", Violations: 2}},
+	}
+
+	tests := map[string]struct {
+		format string
+		check  func(t *testing.T, out string)
+	}{
+		"json": {
+			format: formatJSON,
+			check: func(t *testing.T, out string) {
+				var got auditReport
+				require.NoError(t, json.Unmarshal([]byte(out), &got))
+				require.Equal(t, report.ByRuleset, got.ByRuleset)
+			},
+		},
+		"csv": {
+			format: formatCSV,
+			check: func(t *testing.T, out string) {
+				rows, err := csv.NewReader(bytes.NewBufferString(out)).ReadAll()
+				require.NoError(t, err)
+				require.Len(t, rows, 3)
+				require.Equal(t, "bad | worse", rows[1][5])
+			},
+		},
+		"markdown": {
+			format: formatMarkdown,
+			check: func(t *testing.T, out string) {
+				require.Contains(t, out, `| bad \| worse | 2 |`)
+			},
+		},
+		"html": {
+			format: formatHTML,
+			check: func(t *testing.T, out string) {
+				require.Contains(t, out, "<td>&lt;script&gt;</td>")
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			require.NoError(t, writeReport(&out, tc.format, report))
+			tc.check(t, out.String())
+		})
+	}
+}
+
+func TestCountViolations(t *testing.T) {
+	violations := []evalResult{
+		{Violation: Violation{Kind: "Service"}},
+		{Violation: Violation{Kind: "Deployment"}},
+		{Violation: Violation{Kind: "Service"}},
+		{Violation: Violation{Kind: "DaemonSet"}},
+	}
+	want := []auditCount{{Name: "Service", Violations: 2}, {Name: "DaemonSet", Violations: 1}, {Name: "Deployment", Violations: 1}}
+	require.Equal(t, want, countViolations(violations, func(r evalResult) string { return r.Kind }))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// Statuses commands exit with. exitViolations is also used when tests fail
+const (
+	exitOK         = 0
+	exitViolations = 1
+	exitError      = 2
+)
+
+// commands are the subcommands kove may be run with, by name, each returning the
+// status to exit with. Without one, kove watches the cluster
+var commands = map[string]func(args []string) int{
+	"audit": auditCommand,
+	"eval":  evalCommand,
+	"test":  testCommand,
+
+	"validate-config": validateCommand,
+}
+
+// setupCommand loads the config at the given path, or config.yaml in the working
+// directory, and compiles its policies for a command to evaluate objects with
+func setupCommand(path string) error {
+	configPath = &path
+	c, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("unable to load config: %w", err)
+	}
+	conf.Store(c)
+
+	if _, err := policies.compile(context.Background(), c.Bundles); err != nil {
+		return fmt.Errorf("unable to prepare query from policy data: %w", err)
+	}
+	return nil
+}
+
+// parseStatus returns the status to exit with when a command's flags can't be parsed.
+// Asking for help isn't an error
+func parseStatus(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	return exitError
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupCommand(t *testing.T) {
+	defer initConfig()
+
+	require.NoError(t, setupCommand("example/config/config.yaml"))
+	ready, err := policies.ready()
+	require.NoError(t, err)
+	require.True(t, ready)
+
+	require.Error(t, setupCommand(filepath.Join(t.TempDir(), "missing.yaml")))
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("policies:\n  - missing/policies\n"), 0o644))
+	require.Error(t, setupCommand(path))
+}
+
+func TestParseStatus(t *testing.T) {
+	require.Equal(t, exitOK, parseStatus(flag.ErrHelp))
+	require.Equal(t, exitError, parseStatus(os.ErrInvalid))
+}
@@ -1,26 +1,174 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
 
+	"github.com/prometheus/common/model"
 	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	klog "k8s.io/klog/v2"
 )
 
-// config outlines which namespace to watch objects in and which objects to watch
+// config outlines which namespaces to watch objects in and which objects to watch
 type config struct {
-	Namespace            string                        `yaml:"namespace,omitempty"`
-	Objects              []schema.GroupVersionResource `yaml:"objects,omitempty"`
-	Policies             []string                      `yaml:"policies,omitempty"`
-	IgnoreChildren       bool                          `yaml:"ignoreChildren,omitempty"`
-	IgnoreKinds          []string                      `yaml:"ignoreKinds,omitempty"`
-	IgnoreDifferingPaths []string                      `yaml:"ignoreDifferingPaths,omitempty"`
-	RegoQuery            string                        `yaml:"regoQuery,omitempty"`
+	Namespace              string               `yaml:"namespace,omitempty"`
+	Namespaces             []string             `yaml:"namespaces,omitempty"`
+	ExcludeNamespaces      []string             `yaml:"excludeNamespaces,omitempty"`
+	NamespaceSelector      string               `yaml:"namespaceSelector,omitempty"`
+	Objects                []objectConfig       `yaml:"objects,omitempty"`
+	LabelSelector          string               `yaml:"labelSelector,omitempty"`
+	FieldSelector          string               `yaml:"fieldSelector,omitempty"`
+	Policies               []string             `yaml:"policies,omitempty"`
+	IgnoreChildren         bool                 `yaml:"ignoreChildren,omitempty"`
+	IgnoreKinds            []string             `yaml:"ignoreKinds,omitempty"`
+	IgnoreDifferingPaths   []string             `yaml:"ignoreDifferingPaths,omitempty"`
+	RegoQuery              string               `yaml:"regoQuery,omitempty"`
+	Queries                []queryConfig        `yaml:"queries,omitempty"`
+	Bundles                []bundleConfig       `yaml:"bundles,omitempty"`
+	Severity               severityConfig       `yaml:"severity,omitempty"`
+	Labels                 labelsConfig         `yaml:"labels,omitempty"`
+	Limits                 limitsConfig         `yaml:"limits,omitempty"`
+	DisableViolationSeries bool                 `yaml:"disableViolationSeries,omitempty"`
+	Events                 eventsConfig         `yaml:"events,omitempty"`
+	Workers                int                  `yaml:"workers,omitempty"`
+	ReevaluateInterval     time.Duration        `yaml:"reevaluateInterval,omitempty"`
+	LeaderElection         leaderElectionConfig `yaml:"leaderElection,omitempty"`
+	Sharding               shardingConfig       `yaml:"sharding,omitempty"`
+
+	// Parsed from NamespaceSelector
+	namespaceSelector labels.Selector
+}
+
+// namespaced reports whether we're restricted to particular namespaces,
+// in which case cluster scoped objects are not watched
+func (c *config) namespaced() bool {
+	return len(c.Namespaces) > 0 || c.NamespaceSelector != ""
+}
+
+// objectConfig outlines a kind of object to watch, and optionally which of them to watch.
+// Selectors are applied when listing & watching, so unselected objects are never held in memory
+type objectConfig struct {
+	schema.GroupVersionResource `mapstructure:",squash" yaml:",inline"`
+	LabelSelector               string `yaml:"labelSelector,omitempty"`
+	FieldSelector               string `yaml:"fieldSelector,omitempty"`
+}
+
+// tweakListOptions applies the object's selectors to list & watch requests
+func (o objectConfig) tweakListOptions(options *metav1.ListOptions) {
+	options.LabelSelector = o.LabelSelector
+	options.FieldSelector = o.FieldSelector
+}
+
+// bundleConfig outlines a set of policies, the queries surfacing their violations and the
+// objects they apply to. A bundle without objects or kinds applies to every object
+type bundleConfig struct {
+	Name      string                        `yaml:"name"`
+	Policies  []string                      `yaml:"policies,omitempty"`
+	RegoQuery string                        `yaml:"regoQuery,omitempty"`
+	Queries   []queryConfig                 `yaml:"queries,omitempty"`
+	Objects   []schema.GroupVersionResource `yaml:"objects,omitempty"`
+	Kinds     []string                      `yaml:"kinds,omitempty"`
+}
+
+// queryConfig outlines a named Rego query, and the metric its violations are exported
+// as. Without a metric of their own, violations are exported as opa_policy_violation
+type queryConfig struct {
+	Name   string `yaml:"name"`
+	Query  string `yaml:"query"`
+	Metric string `yaml:"metric,omitempty"`
+}
+
+// appliesTo reports whether the bundle's policies should be evaluated against
+// objects of the given resource & kind
+func (b bundleConfig) appliesTo(gvr schema.GroupVersionResource, kind string) bool {
+	if len(b.Objects) == 0 && len(b.Kinds) == 0 {
+		return true
+	}
+	for _, o := range b.Objects {
+		if o == gvr {
+			return true
+		}
+	}
+	for _, k := range b.Kinds {
+		if strings.EqualFold(k, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// severityConfig outlines the severities policies may give violations, and the
+// severity of violations without one
+type severityConfig struct {
+	Default string   `yaml:"default,omitempty"`
+	Levels  []string `yaml:"levels,omitempty"`
+}
+
+// labelsConfig outlines which labels of policy output are exported as Prometheus labels.
+// As every series of a metric must have the same labels, they're fixed by an allow-list
+type labelsConfig struct {
+	Allow     []string `yaml:"allow,omitempty"`
+	MaxValues int      `yaml:"maxValues,omitempty"`
+}
+
+// limitsConfig outlines how many violation series we export, protecting Prometheus from
+// policies violated by many objects. Series limits of zero are unlimited
+type limitsConfig struct {
+	MaxSeries             int `yaml:"maxSeries,omitempty"`
+	MaxSeriesPerRuleset   int `yaml:"maxSeriesPerRuleset,omitempty"`
+	MaxSeriesPerNamespace int `yaml:"maxSeriesPerNamespace,omitempty"`
+	MaxDataLength         int `yaml:"maxDataLength,omitempty"`
+}
+
+// eventsConfig outlines the Kubernetes Events recorded against objects as their violations
+// appear & resolve. Events of each object are rate limited to qps, with bursts of burst.
+// Without these, client-go's defaults are used
+type eventsConfig struct {
+	Enabled bool    `yaml:"enabled,omitempty"`
+	QPS     float32 `yaml:"qps,omitempty"`
+	Burst   int     `yaml:"burst,omitempty"`
 }
 
-// getConfig returns a default config object
+// shardingConfig outlines how objects are split between replicas
+type shardingConfig struct {
+	Shards int    `yaml:"shards,omitempty"`
+	Index  *int   `yaml:"index,omitempty"`
+	Key    string `yaml:"key,omitempty"`
+}
+
+// leaderElectionConfig outlines how replicas elect a leader to evaluate objects
+type leaderElectionConfig struct {
+	Enabled        bool          `yaml:"enabled,omitempty"`
+	LeaseName      string        `yaml:"leaseName,omitempty"`
+	LeaseNamespace string        `yaml:"leaseNamespace,omitempty"`
+	LeaseDuration  time.Duration `yaml:"leaseDuration,omitempty"`
+	RenewDeadline  time.Duration `yaml:"renewDeadline,omitempty"`
+	RetryPeriod    time.Duration `yaml:"retryPeriod,omitempty"`
+}
+
+// getConfig returns a default config object, exiting if it cannot be loaded
 func getConfig() *config {
+	conf, err := loadConfig()
+	if err != nil {
+		klog.ErrorS(err, "unable to load config")
+		os.Exit(1)
+	}
+	return conf
+}
+
+// loadConfig reads the config from disk and applies our defaults.
+// If the config is invalid, what could be decoded of it is returned alongside every
+// problem found, so it can be checked further. Callers must not use it otherwise
+func loadConfig() (*config, error) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(".")
@@ -29,21 +177,168 @@ func getConfig() *config {
 		viper.SetConfigFile(*configPath)
 	}
 	if err := viper.ReadInConfig(); err != nil {
-		klog.ErrorS(err, "unable to read config")
-		os.Exit(1)
+		return nil, fmt.Errorf("unable to read config: %w", err)
 	}
 
+	// Every problem with the config is reported at once, rather than one at a time.
+	// Unknown keys (such as misspelt options) are problems too
+	var errs []error
 	conf := &config{}
-	if err := viper.Unmarshal(conf); err != nil {
-		klog.ErrorS(err, "invalid config")
-		os.Exit(1)
+	if err := viper.UnmarshalExact(conf); err != nil {
+		errs = append(errs, fmt.Errorf("invalid config: %w", err))
+	}
+
+	// The single namespace option predates the list of namespaces
+	if conf.Namespace != "" && !contains(conf.Namespaces, conf.Namespace) {
+		conf.Namespaces = append(conf.Namespaces, conf.Namespace)
+	}
+	selector, err := labels.Parse(conf.NamespaceSelector)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid namespace selector: %w", err))
+	}
+	conf.namespaceSelector = selector
+
+	// Objects without selectors of their own use the defaults
+	seen := make(map[schema.GroupVersionResource]bool)
+	for i := range conf.Objects {
+		o := &conf.Objects[i]
+		if seen[o.GroupVersionResource] {
+			errs = append(errs, fmt.Errorf("object %s is listed more than once", o.GroupVersionResource))
+		}
+		seen[o.GroupVersionResource] = true
+
+		if o.LabelSelector == "" {
+			o.LabelSelector = conf.LabelSelector
+		}
+		if o.FieldSelector == "" {
+			o.FieldSelector = conf.FieldSelector
+		}
+	}
+	for _, o := range append(conf.Objects, objectConfig{LabelSelector: conf.LabelSelector, FieldSelector: conf.FieldSelector}) {
+		if _, err := labels.Parse(o.LabelSelector); err != nil {
+			errs = append(errs, fmt.Errorf("invalid label selector %q: %w", o.LabelSelector, err))
+		}
+		if _, err := fields.ParseSelector(o.FieldSelector); err != nil {
+			errs = append(errs, fmt.Errorf("invalid field selector %q: %w", o.FieldSelector, err))
+		}
 	}
 
 	// Set our defaults or warn for empty values
 	if conf.RegoQuery == "" {
 		conf.RegoQuery = "data[_].main"
 	}
-	if len(conf.Policies) == 0 {
+	if conf.Workers <= 0 {
+		conf.Workers = runtime.NumCPU()
+	}
+
+	// Policies & queries outside of any bundle form a bundle applying to every object
+	if len(conf.Policies) > 0 || len(conf.Queries) > 0 || len(conf.Bundles) == 0 {
+		conf.Bundles = append([]bundleConfig{{Name: "default", Policies: conf.Policies, RegoQuery: conf.RegoQuery, Queries: conf.Queries}}, conf.Bundles...)
+	}
+	names := make(map[string]bool)
+	queries := make(map[string]bool)
+	for i := range conf.Bundles {
+		b := &conf.Bundles[i]
+		if b.Name == "" {
+			errs = append(errs, fmt.Errorf("bundle %d has no name", i))
+		}
+		if names[b.Name] {
+			errs = append(errs, fmt.Errorf("bundle %q is defined more than once", b.Name))
+		}
+		names[b.Name] = true
+
+		if b.RegoQuery == "" {
+			b.RegoQuery = conf.RegoQuery
+		}
+
+		// Without named queries, a bundle's query is named after it
+		if len(b.Queries) == 0 {
+			b.Queries = []queryConfig{{Name: b.Name, Query: b.RegoQuery}}
+		}
+		for j, q := range b.Queries {
+			if q.Name == "" || q.Query == "" {
+				errs = append(errs, fmt.Errorf("query %d of bundle %q needs a name and query", j, b.Name))
+			}
+			if queries[q.Name] {
+				errs = append(errs, fmt.Errorf("query %q is defined more than once", q.Name))
+			}
+			queries[q.Name] = true
+
+			if q.Metric != "" && !model.IsValidMetricName(model.LabelValue(q.Metric)) {
+				errs = append(errs, fmt.Errorf("query %q has an invalid metric name %q", q.Name, q.Metric))
+			}
+		}
+	}
+	if len(conf.Severity.Levels) == 0 {
+		conf.Severity.Levels = []string{"critical", "high", "medium", "low", "info"}
+	}
+	if conf.Severity.Default == "" {
+		conf.Severity.Default = "medium"
+	}
+	if !contains(conf.Severity.Levels, conf.Severity.Default) {
+		errs = append(errs, fmt.Errorf("default severity %q is not one of %q", conf.Severity.Default, conf.Severity.Levels))
+	}
+	for _, l := range conf.Labels.Allow {
+		if !model.LabelName(l).IsValid() || strings.HasPrefix(l, "__") {
+			errs = append(errs, fmt.Errorf("invalid label name %q", l))
+		}
+		if contains(violationLabels, l) {
+			errs = append(errs, fmt.Errorf("label %q is already exported", l))
+		}
+	}
+	if conf.Labels.MaxValues <= 0 {
+		conf.Labels.MaxValues = 100
+	}
+	if conf.Limits.MaxSeries < 0 || conf.Limits.MaxSeriesPerRuleset < 0 || conf.Limits.MaxSeriesPerNamespace < 0 {
+		errs = append(errs, fmt.Errorf("series limits must not be negative"))
+	}
+	if conf.Events.QPS < 0 || conf.Events.Burst < 0 {
+		errs = append(errs, fmt.Errorf("events qps and burst must not be negative"))
+	}
+	if conf.Limits.MaxDataLength <= 0 {
+		conf.Limits.MaxDataLength = 256
+	}
+	if conf.Sharding.Shards > 1 {
+		if conf.Sharding.Key == "" {
+			conf.Sharding.Key = shardByNamespace
+		}
+		if conf.Sharding.Key != shardByNamespace && conf.Sharding.Key != shardByUID {
+			errs = append(errs, fmt.Errorf("invalid sharding key %q, must be %q or %q", conf.Sharding.Key, shardByNamespace, shardByUID))
+		}
+		if conf.Sharding.Index == nil {
+			if ordinal, err := statefulSetOrdinal(); err != nil {
+				errs = append(errs, fmt.Errorf("no sharding index set: %w", err))
+			} else {
+				conf.Sharding.Index = &ordinal
+			}
+		}
+		if conf.Sharding.Index != nil && (*conf.Sharding.Index < 0 || *conf.Sharding.Index >= conf.Sharding.Shards) {
+			errs = append(errs, fmt.Errorf("sharding index %d is out of range for %d shards", *conf.Sharding.Index, conf.Sharding.Shards))
+		}
+	}
+	if conf.LeaderElection.LeaseName == "" {
+		// Replicas of each shard elect their own leader
+		conf.LeaderElection.LeaseName = "kove"
+		if conf.Sharding.Shards > 1 && conf.Sharding.Index != nil {
+			conf.LeaderElection.LeaseName = fmt.Sprintf("kove-shard-%d", *conf.Sharding.Index)
+		}
+	}
+	if conf.LeaderElection.LeaseNamespace == "" {
+		conf.LeaderElection.LeaseNamespace = defaultLeaseNamespace()
+	}
+	if conf.LeaderElection.LeaseDuration <= 0 {
+		conf.LeaderElection.LeaseDuration = 15 * time.Second
+	}
+	if conf.LeaderElection.RenewDeadline <= 0 {
+		conf.LeaderElection.RenewDeadline = 10 * time.Second
+	}
+	if conf.LeaderElection.RetryPeriod <= 0 {
+		conf.LeaderElection.RetryPeriod = 2 * time.Second
+	}
+	if err := errors.Join(errs...); err != nil {
+		return conf, err
+	}
+	if len(conf.policyPaths()) == 0 {
 		klog.Warning("no policies set, all evaluations will be futile")
 	}
 	if len(conf.Objects) == 0 {
@@ -77,5 +372,72 @@ func getConfig() *config {
 			conf.IgnoreDifferingPaths[i] = "Object/" + conf.IgnoreDifferingPaths[i]
 		}
 	}
-	return conf
+	return conf, nil
+}
+
+// policyPaths returns the policy files & directories of every bundle
+func (c *config) policyPaths() []string {
+	var paths []string
+	for _, b := range c.Bundles {
+		paths = append(paths, b.Policies...)
+	}
+	return paths
+}
+
+// restartRequired returns the options that differ between two configs,
+// but only take effect on startup
+func restartRequired(old, new *config) []string {
+	var changed []string
+	if !reflect.DeepEqual(old.Namespaces, new.Namespaces) {
+		changed = append(changed, "namespaces")
+	}
+	if old.NamespaceSelector != new.NamespaceSelector {
+		changed = append(changed, "namespaceSelector")
+	}
+	if !reflect.DeepEqual(old.Objects, new.Objects) {
+		changed = append(changed, "objects")
+	}
+	if old.LabelSelector != new.LabelSelector {
+		changed = append(changed, "labelSelector")
+	}
+	if old.FieldSelector != new.FieldSelector {
+		changed = append(changed, "fieldSelector")
+	}
+	if old.Workers != new.Workers {
+		changed = append(changed, "workers")
+	}
+	if !reflect.DeepEqual(old.Labels.Allow, new.Labels.Allow) {
+		changed = append(changed, "labels.allow")
+	}
+	if old.ReevaluateInterval != new.ReevaluateInterval {
+		changed = append(changed, "reevaluateInterval")
+	}
+	if old.Events != new.Events {
+		changed = append(changed, "events")
+	}
+	if old.LeaderElection != new.LeaderElection {
+		changed = append(changed, "leaderElection")
+	}
+	if !reflect.DeepEqual(old.Sharding, new.Sharding) {
+		changed = append(changed, "sharding")
+	}
+	return changed
+}
+
+// keepRestartRequired copies the options that only take effect on startup from the
+// running config into a reloaded one, so reloading never applies them part way
+func keepRestartRequired(running, reloaded *config) {
+	reloaded.Namespace = running.Namespace
+	reloaded.Namespaces = running.Namespaces
+	reloaded.NamespaceSelector = running.NamespaceSelector
+	reloaded.namespaceSelector = running.namespaceSelector
+	reloaded.Objects = running.Objects
+	reloaded.LabelSelector = running.LabelSelector
+	reloaded.FieldSelector = running.FieldSelector
+	reloaded.Workers = running.Workers
+	reloaded.Labels.Allow = running.Labels.Allow
+	reloaded.ReevaluateInterval = running.ReevaluateInterval
+	reloaded.Events = running.Events
+	reloaded.LeaderElection = running.LeaderElection
+	reloaded.Sharding = running.Sharding
 }
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestLoadConfigSelectors(t *testing.T) {
+	tests := map[string]struct {
+		config  string
+		want    []objectConfig
+		wantErr bool
+	}{
+		"defaults": {
+			config: `
+labelSelector: team=payments
+fieldSelector: metadata.namespace!=kube-system
+objects:
+  - group: apps
+    version: v1
+    resource: deployments
+  - group: apps
+    version: v1
+    resource: daemonsets
+    labelSelector: app=agent
+`,
+			want: []objectConfig{
+				{LabelSelector: "team=payments", FieldSelector: "metadata.namespace!=kube-system"},
+				{LabelSelector: "app=agent", FieldSelector: "metadata.namespace!=kube-system"},
+			},
+		},
+		"invalid label selector": {
+			config: `
+objects:
+  - group: apps
+    version: v1
+    resource: deployments
+    labelSelector: "team in payments"
+`,
+			wantErr: true,
+		},
+		"invalid field selector": {
+			config:  `fieldSelector: "metadata.name"`,
+			wantErr: true,
+		},
+		"duplicate objects": {
+			config: `
+objects:
+  - group: apps
+    version: v1
+    resource: deployments
+  - group: apps
+    version: v1
+    resource: deployments
+    labelSelector: app=agent
+`,
+			wantErr: true,
+		},
+	}
+
+	defer initConfig()
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.config), 0o644))
+			configPath = &path
+
+			c, err := loadConfig()
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, c.Objects, len(tc.want))
+			for i, want := range tc.want {
+				require.Equal(t, "apps", c.Objects[i].Group)
+
+				var opts metav1.ListOptions
+				c.Objects[i].tweakListOptions(&opts)
+				require.Equal(t, want.LabelSelector, opts.LabelSelector)
+				require.Equal(t, want.FieldSelector, opts.FieldSelector)
+			}
+		})
+	}
+}
+
+func TestLoadConfigBundles(t *testing.T) {
+	tests := map[string]struct {
+		config  string
+		want    []bundleConfig
+		wantErr bool
+	}{
+		"policies without bundles": {
+			config: `
+policies:
+  - example/policies
+`,
+			want: []bundleConfig{
+				{Name: "default", Policies: []string{"example/policies"}, RegoQuery: "data[_].main", Queries: []queryConfig{{Name: "default", Query: "data[_].main"}}},
+			},
+		},
+		"bundles": {
+			config: `
+regoQuery: data.kove.main
+bundles:
+  - name: deprecations
+    policies:
+      - policies/deprecations
+    kinds:
+      - Deployment
+  - name: services
+    policies:
+      - policies/services
+    regoQuery: data.services.main
+    objects:
+      - version: v1
+        resource: services
+`,
+			want: []bundleConfig{
+				{Name: "deprecations", Policies: []string{"policies/deprecations"}, RegoQuery: "data.kove.main", Queries: []queryConfig{{Name: "deprecations", Query: "data.kove.main"}}, Kinds: []string{"Deployment"}},
+				{Name: "services", Policies: []string{"policies/services"}, RegoQuery: "data.services.main", Queries: []queryConfig{{Name: "services", Query: "data.services.main"}}, Objects: []schema.GroupVersionResource{{Version: "v1", Resource: "services"}}},
+			},
+		},
+		"policies and bundles": {
+			config: `
+policies:
+  - example/policies
+bundles:
+  - name: deprecations
+    policies:
+      - policies/deprecations
+`,
+			want: []bundleConfig{
+				{Name: "default", Policies: []string{"example/policies"}, RegoQuery: "data[_].main", Queries: []queryConfig{{Name: "default", Query: "data[_].main"}}},
+				{Name: "deprecations", Policies: []string{"policies/deprecations"}, RegoQuery: "data[_].main", Queries: []queryConfig{{Name: "deprecations", Query: "data[_].main"}}},
+			},
+		},
+		"named queries": {
+			config: `
+policies:
+  - example/policies
+queries:
+  - name: deprecation
+    query: data.deprecation.main
+  - name: security
+    query: data.security.main
+    metric: kove_security_violation
+`,
+			want: []bundleConfig{
+				{Name: "default", Policies: []string{"example/policies"}, RegoQuery: "data[_].main", Queries: []queryConfig{
+					{Name: "deprecation", Query: "data.deprecation.main"},
+					{Name: "security", Query: "data.security.main", Metric: "kove_security_violation"},
+				}},
+			},
+		},
+		"duplicate queries": {
+			config: `
+queries:
+  - name: deprecation
+    query: data.deprecation.main
+bundles:
+  - name: deprecations
+    queries:
+      - name: deprecation
+        query: data.deprecation.main
+`,
+			wantErr: true,
+		},
+		"invalid metric": {
+			config: `
+queries:
+  - name: deprecation
+    query: data.deprecation.main
+    metric: kove-deprecations
+`,
+			wantErr: true,
+		},
+		"unnamed bundle": {
+			config: `
+bundles:
+  - policies:
+      - policies/deprecations
+`,
+			wantErr: true,
+		},
+		"duplicate bundles": {
+			config: `
+bundles:
+  - name: deprecations
+  - name: deprecations
+`,
+			wantErr: true,
+		},
+	}
+
+	defer initConfig()
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.config), 0o644))
+			configPath = &path
+
+			c, err := loadConfig()
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, c.Bundles)
+		})
+	}
+}
+
+func TestLoadConfigLabels(t *testing.T) {
+	tests := map[string]struct {
+		config  string
+		wantErr bool
+	}{
+		"allowed": {
+			config: "labels:\n  allow:\n    - team\n    - environment\n",
+		},
+		"invalid name": {
+			config:  "labels:\n  allow:\n    - cost-centre\n",
+			wantErr: true,
+		},
+		"reserved name": {
+			config:  "labels:\n  allow:\n    - __name__\n",
+			wantErr: true,
+		},
+		"already exported": {
+			config:  "labels:\n  allow:\n    - severity\n",
+			wantErr: true,
+		},
+	}
+
+	defer initConfig()
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.config), 0o644))
+			configPath = &path
+
+			c, err := loadConfig()
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, 100, c.Labels.MaxValues)
+		})
+	}
+}
+
+func TestLoadConfigStrict(t *testing.T) {
+	defer initConfig()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := `
+ignoreChildrens: true
+severity:
+  default: urgent
+labels:
+  allow:
+    - severity
+`
+	require.NoError(t, os.WriteFile(path, []byte(config), 0o644))
+	configPath = &path
+
+	// Every problem is reported, including the misspelt option
+	_, err := loadConfig()
+	require.Error(t, err)
+	require.Len(t, joinedErrors(err), 3)
+	require.ErrorContains(t, err, "ignorechildrens")
+}
+
+func TestKeepRestartRequired(t *testing.T) {
+	index := 1
+	running := &config{
+		Namespaces:        []string{"default"},
+		NamespaceSelector: "team=payments",
+		namespaceSelector: labels.SelectorFromSet(labels.Set{"team": "payments"}),
+		Workers:           4,
+		Labels:            labelsConfig{Allow: []string{"team"}},
+	}
+	reloaded := &config{
+		NamespaceSelector: "team=search",
+		namespaceSelector: labels.SelectorFromSet(labels.Set{"team": "search"}),
+		Objects:           []objectConfig{{LabelSelector: "app=agent"}},
+		LabelSelector:     "app=agent",
+		FieldSelector:     "metadata.name=agent",
+		Workers:           8,
+		Labels:            labelsConfig{Allow: []string{"team", "app"}, MaxValues: 10},
+		Events:            eventsConfig{Enabled: true},
+		LeaderElection:    leaderElectionConfig{Enabled: true},
+		Sharding:          shardingConfig{Shards: 2, Index: &index},
+		IgnoreChildren:    true,
+	}
+	require.Len(t, restartRequired(running, reloaded), 10)
+
+	// Only the options that can be reloaded change
+	keepRestartRequired(running, reloaded)
+	require.Empty(t, restartRequired(running, reloaded))
+	require.Equal(t, "team=payments", reloaded.namespaceSelector.String())
+	require.True(t, reloaded.namespaced())
+	require.True(t, reloaded.IgnoreChildren)
+	require.Equal(t, 10, reloaded.Labels.MaxValues)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Formats kove eval may print violations in
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatJUnit = "junit"
+)
+
+// evaluation is the outcome of evaluating a manifest
+type evaluation struct {
+	manifest
+	found []queryViolations
+}
+
+// violations returns the number of violations found in the manifest
+func (e evaluation) violations() int {
+	n := 0
+	for _, qv := range e.found {
+		n += len(qv.violations)
+	}
+	return n
+}
+
+// evalResult is a violation found in a manifest, as printed by kove eval
+type evalResult struct {
+	Source string
+	Query  string
+	Violation
+}
+
+// evalCommand evaluates manifests from files, directories or stdin against our
+// policies, exiting with exitViolations if any violations are found
+func evalCommand(args []string) int {
+	fs := flag.NewFlagSet("eval", flag.ContinueOnError)
+	path := fs.String("config", "", "Path to the configuration")
+	output := fs.String("output", formatTable, "Format to print violations in: table, json or junit")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kove eval [options] [file|directory|-]...\n\nEvaluates manifests against the configured policies. Without paths, manifests are read from stdin.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+
+	if *output != formatTable && *output != formatJSON && *output != formatJUnit {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		return exitError
+	}
+	if err := setupCommand(*path); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	manifests, err := readManifests(paths, os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	evaluations, err := evalManifests(context.Background(), policies, manifests)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if err := printEvaluations(os.Stdout, *output, evaluations); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	for _, e := range evaluations {
+		if e.violations() > 0 {
+			return exitViolations
+		}
+	}
+	return exitOK
+}
+
+// evalManifests evaluates manifests against a set of policies, through the same
+// queries as objects watched in the cluster
+func evalManifests(ctx context.Context, set *policySet, manifests []manifest) ([]evaluation, error) {
+	var evaluations []evaluation
+	for _, m := range manifests {
+		found, err := evaluateObject(ctx, set, guessResource(m.obj), m.obj)
+		if err != nil {
+			return nil, fmt.Errorf("%s: unable to evaluate %s %s: %w", m.source, m.obj.GetKind(), objectName(m.obj.GetNamespace(), m.obj.GetName()), err)
+		}
+		evaluations = append(evaluations, evaluation{manifest: m, found: found})
+	}
+	return evaluations, nil
+}
+
+// printEvaluations prints the violations found in manifests in the given format
+func printEvaluations(w io.Writer, format string, evaluations []evaluation) error {
+	switch format {
+	case formatJSON:
+		return printJSON(w, evaluations)
+	case formatJUnit:
+		return printJUnit(w, evaluations)
+	default:
+		return printTable(w, evaluations)
+	}
+}
+
+// results flattens evaluations into the violations found
+func results(evaluations []evaluation) []evalResult {
+	results := []evalResult{}
+	for _, e := range evaluations {
+		for _, qv := range e.found {
+			for _, v := range qv.violations {
+				results = append(results, evalResult{Source: e.source, Query: qv.query.Name, Violation: v})
+			}
+		}
+	}
+	return results
+}
+
+func printTable(w io.Writer, evaluations []evaluation) error {
+	results := results(evaluations)
+	if len(results) == 0 {
+		_, err := fmt.Fprintln(w, "No violations found")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tNAMESPACE\tKIND\tNAME\tQUERY\tRULESET\tSEVERITY\tDATA")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Source, r.Namespace, r.Kind, r.Name, r.Query, r.RuleSet, r.Severity, r.Data)
+	}
+	return tw.Flush()
+}
+
+func printJSON(w io.Writer, evaluations []evaluation) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results(evaluations))
+}
+
+// junitSuites is a JUnit report, with a test suite for each source of manifests
+// and a test case for each object, failing if it violates policy
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",cdata"`
+}
+
+func printJUnit(w io.Writer, evaluations []evaluation) error {
+	var report junitSuites
+	suites := make(map[string]int)
+	for _, e := range evaluations {
+		i, ok := suites[e.source]
+		if !ok {
+			i = len(report.Suites)
+			suites[e.source] = i
+			report.Suites = append(report.Suites, junitSuite{Name: e.source})
+		}
+
+		c := junitCase{
+			Name:      e.obj.GetKind() + " " + objectName(e.obj.GetNamespace(), e.obj.GetName()),
+			Classname: e.obj.GetAPIVersion(),
+		}
+		if n := e.violations(); n > 0 {
+			var text strings.Builder
+			for _, qv := range e.found {
+				for _, v := range qv.violations {
+					fmt.Fprintf(&text, "%s: %s (%s): %s\n", qv.query.Name, v.RuleSet, v.Severity, v.Data)
+				}
+			}
+			c.Failure = &junitFailure{Message: fmt.Sprintf("%d policy violation(s)", n), Text: text.String()}
+			report.Suites[i].Failures++
+		}
+		report.Suites[i].Tests++
+		report.Suites[i].Cases = append(report.Suites[i].Cases, c)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// objectName returns the namespaced name of an object, as used by kubectl
+func objectName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvalManifests(t *testing.T) {
+	initConfig()
+
+	manifests := []manifest{
+		{source: "old.yaml", obj: newUnstructured("apps/v1", "Deployment", "test", "old", "1", annotationsTeam, getChartLabels("3.0.0"), false)},
+		{source: "new.yaml", obj: newUnstructured("apps/v1", "Deployment", "test", "new", "1", annotationsTeam, getChartLabels("3.0.2"), false)},
+	}
+	evaluations, err := evalManifests(context.Background(), policies, manifests)
+	require.NoError(t, err)
+	require.Len(t, evaluations, 2)
+	require.Equal(t, 1, evaluations[0].violations())
+	require.Equal(t, 0, evaluations[1].violations())
+
+	tests := map[string]struct {
+		format string
+		check  func(t *testing.T, out []byte)
+	}{
+		"table": {
+			format: formatTable,
+			check: func(t *testing.T, out []byte) {
+				lines := bytes.Split(bytes.TrimSpace(out), []byte("\n"))
+				require.Len(t, lines, 2)
+				require.Contains(t, string(lines[1]), "old.yaml")
+				require.Contains(t, string(lines[1]), "Chart version 3.0.0 is lower than the minimum version 3.0.2")
+			},
+		},
+		"json": {
+			format: formatJSON,
+			check: func(t *testing.T, out []byte) {
+				var results []evalResult
+				require.NoError(t, json.Unmarshal(out, &results))
+				require.Len(t, results, 1)
+				require.Equal(t, "old", results[0].Name)
+				require.Equal(t, "default", results[0].Query)
+				require.Equal(t, "test", results[0].Data)
+			},
+		},
+		"junit": {
+			format: formatJUnit,
+			check: func(t *testing.T, out []byte) {
+				var report junitSuites
+				require.NoError(t, xml.Unmarshal(out, &report))
+				require.Len(t, report.Suites, 2)
+				require.Equal(t, 1, report.Suites[0].Failures)
+				require.Equal(t, "Deployment test/old", report.Suites[0].Cases[0].Name)
+				require.Equal(t, 0, report.Suites[1].Failures)
+				require.Nil(t, report.Suites[1].Cases[0].Failure)
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			require.NoError(t, printEvaluations(&out, tc.format, evaluations))
+			tc.check(t, out.Bytes())
+		})
+	}
+}
+
+func TestPrintNoViolations(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, printEvaluations(&out, formatJSON, nil))
+	require.JSONEq(t, "[]", out.String())
+
+	out.Reset()
+	require.NoError(t, printEvaluations(&out, formatTable, nil))
+	require.Equal(t, "No violations found\n", out.String())
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	klog "k8s.io/klog/v2"
+)
+
+// Reasons of the events recorded against objects as their violations appear & resolve
+const (
+	reasonPolicyViolation         = "PolicyViolation"
+	reasonPolicyViolationResolved = "PolicyViolationResolved"
+)
+
+// maxEventMessage is the length event messages are truncated to
+const maxEventMessage = 1024
+
+// flushReason is the reason of the marker recorded when flushing events. Events are written
+// in the order they're recorded, so once the marker reaches our sink, so has every event before it
+const flushReason = "KoveFlush"
+
+// eventRecorder records events against objects as their violations appear & resolve.
+// It's nil unless events are enabled
+var eventRecorder record.EventRecorder
+
+// The broadcaster writing recorded events to the cluster, and its sink
+var (
+	eventBroadcaster record.EventBroadcaster
+	eventSink        *flushSink
+)
+
+// flushSink writes events to the cluster, signalling when the flush marker reaches it
+// rather than writing it
+type flushSink struct {
+	record.EventSink
+	flushed chan struct{}
+}
+
+func (s *flushSink) Create(e *corev1.Event) (*corev1.Event, error) {
+	if e.Reason == flushReason {
+		close(s.flushed)
+		return e, nil
+	}
+	return s.EventSink.Create(e)
+}
+
+// startEvents starts broadcasting the events of eventRecorder to the cluster.
+// Events are aggregated & rate limited by client-go's correlator
+func startEvents(client kubernetes.Interface, ec eventsConfig) {
+	eventBroadcaster = record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		QPS:       ec.QPS,
+		BurstSize: ec.Burst,
+	})
+	eventSink = &flushSink{
+		EventSink: &typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")},
+		flushed:   make(chan struct{}),
+	}
+	eventBroadcaster.StartRecordingToSink(eventSink)
+	eventRecorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "kove"})
+}
+
+// stopEvents waits for the events recorded so far to be written to the cluster, giving up
+// once ctx is done, and stops broadcasting
+func stopEvents(ctx context.Context) {
+	if eventBroadcaster == nil {
+		return
+	}
+
+	klog.InfoS("flushing events")
+	eventRecorder.Event(&corev1.ObjectReference{Kind: "Kove", Name: "flush"}, corev1.EventTypeNormal, flushReason, "flush")
+	select {
+	case <-eventSink.flushed:
+	case <-ctx.Done():
+		klog.InfoS("timed out flushing events")
+	}
+	eventBroadcaster.Shutdown()
+}
+
+// recordViolationEvents records a Warning event against an object for each violation found
+// that wasn't when it was last evaluated, and a Normal event for each that's since resolved.
+// Violations found again aren't recorded, so reevaluating an object doesn't repeat them
+func recordViolationEvents(obj *unstructured.Unstructured, previous, found []queryViolations) {
+	if eventRecorder == nil {
+		return
+	}
+
+	for _, qv := range found {
+		for _, v := range qv.violations {
+			if !hasViolation(previous, qv.query.Name, v) {
+				eventRecorder.Event(obj, corev1.EventTypeWarning, reasonPolicyViolation, eventMessage(qv.query.Name, v))
+			}
+		}
+	}
+	for _, qv := range previous {
+		for _, v := range qv.violations {
+			if !hasViolation(found, qv.query.Name, v) {
+				eventRecorder.Event(obj, corev1.EventTypeNormal, reasonPolicyViolationResolved, "Resolved: "+eventMessage(qv.query.Name, v))
+			}
+		}
+	}
+}
+
+// hasViolation reports whether the given query found a violation of the same ruleset & data
+func hasViolation(found []queryViolations, query string, v Violation) bool {
+	for _, qv := range found {
+		if qv.query.Name != query {
+			continue
+		}
+		for _, f := range qv.violations {
+			if f.RuleSet == v.RuleSet && f.Data == v.Data {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// eventMessage describes a violation in an event
+func eventMessage(query string, v Violation) string {
+	msg := v.RuleSet
+	if v.Data != "" {
+		msg += ": " + v.Data
+	}
+	return truncateData(fmt.Sprintf("%s (query %s, severity %s)", msg, query, v.Severity), maxEventMessage)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRecordViolationEvents(t *testing.T) {
+	obj := newUnstructured("apps/v1", "Deployment", "test", "test", "1", emptyMap, emptyMap, false)
+	kept := objectViolation(obj, "kept", "medium")
+	resolved := objectViolation(obj, "resolved", "low")
+	added := objectViolation(obj, "added", "high")
+
+	tests := map[string]struct {
+		previous []queryViolations
+		found    []queryViolations
+		want     []string
+	}{
+		"new violations": {
+			found: []queryViolations{{query: testQuery, violations: []Violation{kept}}},
+			want:  []string{"Warning PolicyViolation kept"},
+		},
+		"unchanged violations": {
+			previous: []queryViolations{{query: testQuery, violations: []Violation{kept}}},
+			found:    []queryViolations{{query: testQuery, violations: []Violation{kept}}},
+		},
+		"changed violations": {
+			previous: []queryViolations{{query: testQuery, violations: []Violation{kept, resolved}}},
+			found:    []queryViolations{{query: testQuery, violations: []Violation{kept, added}}},
+			want: []string{
+				"Warning PolicyViolation added",
+				"Normal PolicyViolationResolved Resolved: resolved",
+			},
+		},
+		"resolved violations": {
+			previous: []queryViolations{{query: testQuery, violations: []Violation{resolved}}},
+			found:    []queryViolations{{query: testQuery}},
+			want:     []string{"Normal PolicyViolationResolved Resolved: resolved"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+			defer func() { eventRecorder = nil }()
+
+			recordViolationEvents(obj, tc.previous, tc.found)
+			close(recorder.Events)
+
+			var got []string
+			for e := range recorder.Events {
+				got = append(got, e)
+			}
+			require.Len(t, got, len(tc.want))
+			for i, want := range tc.want {
+				require.True(t, strings.HasPrefix(got[i], want), "event %q should start with %q", got[i], want)
+			}
+		})
+	}
+}
+
+func TestEventMessage(t *testing.T) {
+	v := Violation{RuleSet: "ruleset", Data: "data", Severity: "high"}
+	require.Equal(t, "ruleset: data (query test, severity high)", eventMessage("test", v))
+
+	v.Data = strings.Repeat("x", 2*maxEventMessage)
+	require.Len(t, eventMessage("test", v), maxEventMessage)
+}
+
+func TestStopEvents(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	startEvents(client, eventsConfig{})
+	defer func() {
+		eventBroadcaster, eventSink, eventRecorder = nil, nil, nil
+	}()
+
+	obj := newUnstructured("apps/v1", "Deployment", "test", "test", "1", emptyMap, emptyMap, false)
+	recordViolationEvents(obj, nil, []queryViolations{{query: testQuery, violations: []Violation{objectViolation(obj, "bad", "high")}}})
+
+	// Events recorded before stopping are written, but the flush marker isn't
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stopEvents(ctx)
+	require.NoError(t, ctx.Err(), "flushed before the timeout")
+
+	events, err := client.CoreV1().Events("").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, events.Items, 1)
+	require.Equal(t, reasonPolicyViolation, events.Items[0].Reason)
+	require.Equal(t, "test", events.Items[0].Namespace)
+}
@@ -0,0 +1,20 @@
+package appchart_version
+
+chart(version) = {
+	"apiVersion": "apps/v1",
+	"kind": "Deployment",
+	"metadata": {
+		"name": "test",
+		"namespace": "default",
+		"labels": {"helm.sh/chart": sprintf("specific-chart-name-%s", [version])},
+		"annotations": {"company.domain/team": "payments"},
+	},
+}
+
+test_old_chart_violates {
+	count(main) == 1 with input as chart("3.0.0")
+}
+
+test_current_chart_passes {
+	count(main) == 0 with input as chart("3.0.2")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	klog "k8s.io/klog/v2"
+)
+
+// health tracks the state reported by our readiness and liveness endpoints
+var health = newHealthState()
+
+// healthState records the informers we've started and how far along we are
+type healthState struct {
+	mu        sync.RWMutex
+	informers map[string]*informerHealth
+
+	// Set once every informer has synced and the resulting evaluations are done
+	evaluated atomic.Bool
+
+	// How long an informer may fail to watch its resource before we consider it stalled
+	stallTimeout time.Duration
+}
+
+// informerHealth tracks watch failures of an informer
+type informerHealth struct {
+	informer cache.SharedIndexInformer
+
+	// When the informer started failing to watch, and the resource version it
+	// had at the time. Once the resource version moves on, it has recovered
+	failingSince   time.Time
+	failingVersion string
+}
+
+// readyResponse is the JSON body served by our readiness endpoint
+type readyResponse struct {
+	Ready            bool     `json:"ready"`
+	PoliciesLoaded   bool     `json:"policiesLoaded"`
+	PolicyError      string   `json:"policyError,omitempty"`
+	Evaluated        bool     `json:"evaluated"`
+	PendingResources []string `json:"pendingResources,omitempty"`
+}
+
+// liveResponse is the JSON body served by our liveness endpoint
+type liveResponse struct {
+	Live             bool     `json:"live"`
+	StalledResources []string `json:"stalledResources,omitempty"`
+}
+
+// newHealthState returns a health state with no informers
+func newHealthState() *healthState {
+	return &healthState{
+		informers:    make(map[string]*informerHealth),
+		stallTimeout: 5 * time.Minute,
+	}
+}
+
+// addInformer tracks an informer by the name of the resource it watches.
+// This must be called before the informer is started
+func (h *healthState) addInformer(name string, informer cache.SharedIndexInformer) {
+	ih := &informerHealth{informer: informer}
+
+	h.mu.Lock()
+	h.informers[name] = ih
+	h.mu.Unlock()
+
+	err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		cache.DefaultWatchErrorHandler(r, err)
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if ih.failingSince.IsZero() || ih.informer.LastSyncResourceVersion() != ih.failingVersion {
+			ih.failingSince = time.Now()
+			ih.failingVersion = ih.informer.LastSyncResourceVersion()
+		}
+	})
+	if err != nil {
+		klog.ErrorS(err, "unable to track watch errors", "resource", name)
+	}
+}
+
+// waitForFirstPass marks the first evaluation pass as finished once every informer
+// has synced and the queue has been drained of the resulting evaluations
+func (h *healthState) waitForFirstPass(stopCh <-chan struct{}) {
+	h.mu.RLock()
+	var synced []cache.InformerSynced
+	for _, ih := range h.informers {
+		synced = append(synced, ih.informer.HasSynced)
+	}
+	h.mu.RUnlock()
+
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		return
+	}
+	klog.InfoS("informers synced")
+
+	err := wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		return queue.Len() == 0 && inFlight.Load() == 0, nil
+	}, stopCh)
+	if err != nil {
+		return
+	}
+
+	h.evaluated.Store(true)
+	klog.InfoS("initial evaluation complete")
+}
+
+// pending returns the resources whose informers have not yet synced
+func (h *healthState) pending() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var resources []string
+	for name, ih := range h.informers {
+		if !ih.informer.HasSynced() {
+			resources = append(resources, name)
+		}
+	}
+	sort.Strings(resources)
+	return resources
+}
+
+// stalled returns the resources whose informers have been failing to watch
+// for longer than our stall timeout
+func (h *healthState) stalled() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var resources []string
+	for name, ih := range h.informers {
+		if ih.failingSince.IsZero() {
+			continue
+		}
+		if ih.informer.LastSyncResourceVersion() != ih.failingVersion {
+			ih.failingSince = time.Time{}
+			continue
+		}
+		if time.Since(ih.failingSince) > h.stallTimeout {
+			resources = append(resources, name)
+		}
+	}
+	sort.Strings(resources)
+	return resources
+}
+
+// readyz reports ready once every informer has synced, our policies have compiled
+// and the first evaluation pass has finished.
+// If a policy reload fails, we stay ready with the previous policies, but report the error
+func readyz(w http.ResponseWriter, _ *http.Request) {
+	loaded, err := policies.ready()
+	resp := readyResponse{
+		PoliciesLoaded:   loaded,
+		Evaluated:        health.evaluated.Load(),
+		PendingResources: health.pending(),
+	}
+	if err != nil {
+		resp.PolicyError = err.Error()
+	}
+	resp.Ready = resp.PoliciesLoaded && resp.Evaluated && len(resp.PendingResources) == 0
+
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, resp)
+}
+
+// livez reports live unless an informer has stalled
+func livez(w http.ResponseWriter, _ *http.Request) {
+	resp := liveResponse{StalledResources: health.stalled()}
+	resp.Live = len(resp.StalledResources) == 0
+
+	status := http.StatusOK
+	if !resp.Live {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, resp)
+}
+
+// writeHealth writes a health response as JSON
+func writeHealth(w http.ResponseWriter, status int, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		klog.ErrorS(err, "unable to write health response")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fakeInformer is an informer reporting a fixed sync state and resource version
+type fakeInformer struct {
+	cache.SharedIndexInformer
+	synced  bool
+	version string
+}
+
+func (f *fakeInformer) HasSynced() bool {
+	return f.synced
+}
+
+func (f *fakeInformer) LastSyncResourceVersion() string {
+	return f.version
+}
+
+func TestReadyz(t *testing.T) {
+	initConfig()
+
+	tests := map[string]struct {
+		policies    *policySet
+		evaluated   bool
+		informers   map[string]bool
+		want        int
+		wantPending []string
+	}{
+		"no policies": {
+			policies:  newPolicySet(),
+			evaluated: true,
+			want:      http.StatusServiceUnavailable,
+		},
+		"not evaluated": {
+			policies:  policies,
+			evaluated: false,
+			want:      http.StatusServiceUnavailable,
+		},
+		"pending informers": {
+			policies:  policies,
+			evaluated: true,
+			informers: map[string]bool{
+				"apps/v1, Resource=deployments": false,
+				"apps/v1, Resource=daemonsets":  true,
+				"v1, Resource=services":         false,
+			},
+			want:        http.StatusServiceUnavailable,
+			wantPending: []string{"apps/v1, Resource=deployments", "v1, Resource=services"},
+		},
+		"ready": {
+			policies:  policies,
+			evaluated: true,
+			informers: map[string]bool{"apps/v1, Resource=deployments": true},
+			want:      http.StatusOK,
+		},
+	}
+
+	compiled := policies
+	defer func() {
+		policies = compiled
+		health = newHealthState()
+	}()
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			policies = tc.policies
+			health = newHealthState()
+			health.evaluated.Store(tc.evaluated)
+			for resource, synced := range tc.informers {
+				health.informers[resource] = &informerHealth{informer: &fakeInformer{synced: synced}}
+			}
+
+			rec := httptest.NewRecorder()
+			readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			require.Equal(t, tc.want, rec.Code)
+
+			var resp readyResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			require.Equal(t, tc.want == http.StatusOK, resp.Ready)
+			require.Equal(t, tc.wantPending, resp.PendingResources)
+		})
+	}
+}
+
+func TestLivez(t *testing.T) {
+	const resource = "apps/v1, Resource=deployments"
+
+	tests := map[string]struct {
+		informer    *informerHealth
+		want        int
+		wantStalled []string
+		wantFailing bool
+	}{
+		"no informers": {
+			want: http.StatusOK,
+		},
+		"watching": {
+			informer: &informerHealth{informer: &fakeInformer{synced: true, version: "1"}},
+			want:     http.StatusOK,
+		},
+		"failing within timeout": {
+			informer: &informerHealth{
+				informer:       &fakeInformer{synced: true, version: "1"},
+				failingSince:   time.Now().Add(-time.Minute),
+				failingVersion: "1",
+			},
+			want:        http.StatusOK,
+			wantFailing: true,
+		},
+		"stalled": {
+			informer: &informerHealth{
+				informer:       &fakeInformer{synced: true, version: "1"},
+				failingSince:   time.Now().Add(-10 * time.Minute),
+				failingVersion: "1",
+			},
+			want:        http.StatusServiceUnavailable,
+			wantStalled: []string{resource},
+			wantFailing: true,
+		},
+		"recovered": {
+			informer: &informerHealth{
+				informer:       &fakeInformer{synced: true, version: "2"},
+				failingSince:   time.Now().Add(-10 * time.Minute),
+				failingVersion: "1",
+			},
+			want: http.StatusOK,
+		},
+	}
+
+	defer func() { health = newHealthState() }()
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			health = newHealthState()
+			if tc.informer != nil {
+				health.informers[resource] = tc.informer
+			}
+
+			rec := httptest.NewRecorder()
+			livez(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+			require.Equal(t, tc.want, rec.Code)
+
+			var resp liveResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			require.Equal(t, tc.want == http.StatusOK, resp.Live)
+			require.Equal(t, tc.wantStalled, resp.StalledResources)
+
+			// Once the resource version moves on, the informer is no longer considered failing
+			if tc.informer != nil {
+				require.Equal(t, tc.wantFailing, !tc.informer.failingSince.IsZero())
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Limits which may prevent a violation being exported as a series, used as the
+// 'reason' label of opa_policy_violation_series_dropped_total
+const (
+	limitTotal     = "total"
+	limitRuleset   = "ruleset"
+	limitNamespace = "namespace"
+)
+
+// currentViolations records the violations currently found in each evaluated object, from which
+// aggregate metrics are derived and the number of series we export is limited
+var currentViolations = newViolationIndex()
+
+// objectRef identifies an object we've evaluated
+type objectRef struct {
+	APIVersion string
+	Kind       string
+	Namespace  string
+	Name       string
+}
+
+// refFor returns the reference of an object
+func refFor(obj *unstructured.Unstructured) objectRef {
+	return objectRef{APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName()}
+}
+
+// indexEntry holds the violations found in an object, and those exported as series
+type indexEntry struct {
+	key      objectKey
+	found    []queryViolations
+	exported []Violation
+}
+
+// violationIndex holds the violations found by each query in every evaluated object,
+// along with the number of series exported for them
+type violationIndex struct {
+	mu      sync.RWMutex
+	objects map[objectRef]*indexEntry
+
+	// The reference of each object by its queue key, so objects no longer
+	// in our informer caches can be removed by key
+	keys map[objectKey]objectRef
+
+	series      int
+	byRuleset   map[string]int
+	byNamespace map[string]int
+}
+
+// droppedViolation is a violation that wasn't exported, as it would exceed one of our limits
+type droppedViolation struct {
+	query  queryConfig
+	v      Violation
+	reason string
+}
+
+// newViolationIndex returns an empty index
+func newViolationIndex() *violationIndex {
+	return &violationIndex{
+		objects:     make(map[objectRef]*indexEntry),
+		keys:        make(map[objectKey]objectRef),
+		byRuleset:   make(map[string]int),
+		byNamespace: make(map[string]int),
+	}
+}
+
+// found returns the violations each query found in an object when it was last evaluated
+func (i *violationIndex) found(obj *unstructured.Unstructured) []queryViolations {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if e, ok := i.objects[refFor(obj)]; ok {
+		return e.found
+	}
+	return nil
+}
+
+// record replaces the recorded violations of an object watched through the given resource,
+// returning those which may be exported as series within our limits, and those which may not
+func (i *violationIndex) record(gvr schema.GroupVersionResource, obj *unstructured.Unstructured, found []queryViolations, limits limitsConfig) ([]queryViolations, []droppedViolation) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	ref := refFor(obj)
+	i.release(ref)
+
+	e := &indexEntry{key: objectKey{GVR: gvr, Namespace: obj.GetNamespace(), Name: obj.GetName()}, found: found}
+	var exported []queryViolations
+	var dropped []droppedViolation
+	for _, qv := range found {
+		admitted := queryViolations{query: qv.query}
+		for _, v := range qv.violations {
+			if reason := i.exceeds(v, limits); reason != "" {
+				dropped = append(dropped, droppedViolation{query: qv.query, v: v, reason: reason})
+				continue
+			}
+			i.series++
+			i.byRuleset[v.RuleSet]++
+			i.byNamespace[v.Namespace]++
+			e.exported = append(e.exported, v)
+			admitted.violations = append(admitted.violations, v)
+		}
+		exported = append(exported, admitted)
+	}
+
+	i.objects[ref] = e
+	i.keys[e.key] = ref
+	return exported, dropped
+}
+
+// exceeds returns the limit exporting a violation would exceed, if any.
+// Limits of zero are unlimited
+func (i *violationIndex) exceeds(v Violation, limits limitsConfig) string {
+	switch {
+	case limits.MaxSeries > 0 && i.series >= limits.MaxSeries:
+		return limitTotal
+	case limits.MaxSeriesPerRuleset > 0 && i.byRuleset[v.RuleSet] >= limits.MaxSeriesPerRuleset:
+		return limitRuleset
+	case limits.MaxSeriesPerNamespace > 0 && i.byNamespace[v.Namespace] >= limits.MaxSeriesPerNamespace:
+		return limitNamespace
+	}
+	return ""
+}
+
+// release removes an object from the index, along with its series from our counts.
+// The caller must hold the lock
+func (i *violationIndex) release(ref objectRef) {
+	e, ok := i.objects[ref]
+	if !ok {
+		return
+	}
+	for _, v := range e.exported {
+		i.series--
+		if i.byRuleset[v.RuleSet]--; i.byRuleset[v.RuleSet] <= 0 {
+			delete(i.byRuleset, v.RuleSet)
+		}
+		if i.byNamespace[v.Namespace]--; i.byNamespace[v.Namespace] <= 0 {
+			delete(i.byNamespace, v.Namespace)
+		}
+	}
+	delete(i.objects, ref)
+	if i.keys[e.key] == ref {
+		delete(i.keys, e.key)
+	}
+}
+
+// delete removes the recorded violations of an object
+func (i *violationIndex) delete(obj *unstructured.Unstructured) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.release(refFor(obj))
+}
+
+// deleteKey removes the recorded violations of the object with the given queue key,
+// returning its reference if it had been recorded
+func (i *violationIndex) deleteKey(key objectKey) (objectRef, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	ref, ok := i.keys[key]
+	if ok {
+		i.release(ref)
+	}
+	return ref, ok
+}
+
+// deleteNamespace removes the recorded violations of every object in a namespace
+func (i *violationIndex) deleteNamespace(namespace string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for ref := range i.objects {
+		if ref.Namespace == namespace {
+			i.release(ref)
+		}
+	}
+}
+
+// reset removes every recorded violation
+func (i *violationIndex) reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.objects = make(map[objectRef]*indexEntry)
+	i.keys = make(map[objectKey]objectRef)
+	i.series = 0
+	i.byRuleset = make(map[string]int)
+	i.byNamespace = make(map[string]int)
+}
+
+// each calls fn with every recorded violation, and the query that found it
+func (i *violationIndex) each(fn func(query queryConfig, v Violation)) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	for _, e := range i.objects {
+		for _, qv := range e.found {
+			for _, v := range qv.violations {
+				fn(qv.query, v)
+			}
+		}
+	}
+}
+
+// eachObject calls fn with every evaluated object
+func (i *violationIndex) eachObject(fn func(ref objectRef)) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	for ref := range i.objects {
+		fn(ref)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestViolationIndexRecord(t *testing.T) {
+	tests := map[string]struct {
+		limits      limitsConfig
+		wantDropped map[string]int
+	}{
+		"unlimited": {
+			limits:      limitsConfig{},
+			wantDropped: map[string]int{},
+		},
+		"total": {
+			limits:      limitsConfig{MaxSeries: 3},
+			wantDropped: map[string]int{limitTotal: 2},
+		},
+		"per ruleset": {
+			limits:      limitsConfig{MaxSeriesPerRuleset: 1},
+			wantDropped: map[string]int{limitRuleset: 3},
+		},
+		"per namespace": {
+			limits:      limitsConfig{MaxSeriesPerNamespace: 2},
+			wantDropped: map[string]int{limitNamespace: 1},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			index := newViolationIndex()
+			dropped := make(map[string]int)
+
+			// Two rulesets violated across two namespaces
+			for i, ns := range []string{"a", "a", "a", "b", "b"} {
+				obj := newUnstructured("apps/v1", "Deployment", ns, fmt.Sprintf("test-%d", i), "1", emptyMap, emptyMap, false)
+				v := objectViolation(obj, fmt.Sprintf("ruleset-%d", i%2), "medium")
+				_, d := index.record(testGVR, obj, []queryViolations{{query: testQuery, violations: []Violation{v}}}, tc.limits)
+				for _, dv := range d {
+					dropped[dv.reason]++
+				}
+			}
+			require.Equal(t, tc.wantDropped, dropped)
+
+			// Every violation is indexed, whether or not it's exported
+			n := 0
+			index.each(func(queryConfig, Violation) { n++ })
+			require.Equal(t, 5, n)
+
+			// Removing objects frees their series
+			index.deleteNamespace("a")
+			require.LessOrEqual(t, index.series, 2)
+			index.reset()
+			require.Equal(t, 0, index.series)
+			require.Empty(t, index.byRuleset)
+			require.Empty(t, index.byNamespace)
+		})
+	}
+}
+
+func TestEvaluateSeriesLimit(t *testing.T) {
+	initConfig()
+	c := *conf.Load()
+	c.Limits.MaxSeries = 1
+	conf.Store(&c)
+	defer initConfig()
+	resetViolations()
+	defer resetViolations()
+
+	dropped := testutil.ToFloat64(totalSeriesDropped.WithLabelValues(testQuery.Name, limitTotal))
+	for _, name := range []string{"first", "second"} {
+		obj := newUnstructured("extensions/v1beta1", "deployment", "test", name, "1", annotationsTeam, getChartLabels("3.0.0"), false)
+		require.NoError(t, evaluate(testGVR, obj))
+	}
+	require.Equal(t, 1, getNumberOfViolations())
+	require.Equal(t, dropped+1, testutil.ToFloat64(totalSeriesDropped.WithLabelValues(testQuery.Name, limitTotal)))
+
+	// Once the first object's series is removed, the second may be exported
+	deleteAllMetricsForObject(newUnstructured("extensions/v1beta1", "deployment", "test", "first", "1", annotationsTeam, getChartLabels("3.0.0"), false))
+	require.NoError(t, evaluate(testGVR, newUnstructured("extensions/v1beta1", "deployment", "test", "second", "1", annotationsTeam, getChartLabels("3.0.0"), false)))
+	require.Equal(t, 1, getNumberOfViolations())
+}
@@ -6,21 +6,27 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/open-policy-agent/opa/rego"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	diff "github.com/r3labs/diff/v2"
+	"github.com/spf13/viper"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
@@ -28,41 +34,82 @@ import (
 )
 
 var (
-	configPath *string
-	conf       *config
-	ruleSet    string
-	data       string
+	configPath      *string
+	serverOpts      serverOptions
+	shutdownTimeout time.Duration
+	conf            atomic.Pointer[config]
+	policies        = newPolicySet()
 
-	wg = new(sync.WaitGroup)
+	// Watches the config & policies so they can be reloaded on change
+	reloadWatcher *watcher
 
-	// Metric type we serve to surface offending objects
-	violation = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "opa_policy_violation",
-			Help: "Kubernetes object violating policy evaluation.",
-		},
-		[]string{"name", "namespace", "kind", "api_version", "ruleset", "data"},
-	)
+	// Serialises reloads, which may be triggered again while one is still compiling
+	reloadMu sync.Mutex
+
+	// Metric type we serve to surface offending objects.
+	// Replaced on startup if configured with extra labels
+	violation = newViolationVec("opa_policy_violation", nil)
 
-	totalViolations = prometheus.NewCounter(
+	totalViolations = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "opa_policy_violations_total",
 			Help: "Total count of policy violations observed.",
 		},
+		[]string{"query"},
 	)
 
-	totalViolationsResolved = prometheus.NewCounter(
+	totalViolationsResolved = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "opa_policy_violations_resolved_total",
 			Help: "Total count of policy violation resolutions observed.",
 		},
+		[]string{"query"},
 	)
 
-	totalObjectEvaluations = prometheus.NewCounter(
+	totalObjectEvaluations = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "opa_object_evaluations_total",
 			Help: "Total count of Kubernetes object evaluations conducted.",
 		},
+		[]string{"query"},
+	)
+
+	totalReloadErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "opa_policy_reload_errors_total",
+			Help: "Total count of failed config or policy reloads.",
+		},
+	)
+
+	totalCompileErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "opa_policy_compile_errors_total",
+			Help: "Total count of errors compiling policies.",
+		},
+		[]string{"package"},
+	)
+
+	totalEvalErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "opa_policy_eval_errors_total",
+			Help: "Total count of errors evaluating policies.",
+		},
+		[]string{"package"},
+	)
+
+	policiesLoaded = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "opa_policies_loaded",
+			Help: "Whether the most recent compilation of the policies succeeded.",
+		},
+	)
+
+	totalOutputErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "opa_policy_output_errors_total",
+			Help: "Total count of policy outputs that could not be decoded into violations.",
+		},
+		[]string{"policy", "reason"},
 	)
 )
 
@@ -71,47 +118,97 @@ func healthz(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// Web server helper
-func serveMetrics(port int) error {
+// registerMetrics registers the metrics we serve
+func registerMetrics() {
 	prometheus.MustRegister(violation)
 	prometheus.MustRegister(totalViolations)
 	prometheus.MustRegister(totalViolationsResolved)
 	prometheus.MustRegister(totalObjectEvaluations)
-
-	http.HandleFunc("/healthz", healthz)
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-
-	return nil
+	prometheus.MustRegister(totalReloadErrors)
+	prometheus.MustRegister(totalCompileErrors)
+	prometheus.MustRegister(totalEvalErrors)
+	prometheus.MustRegister(policiesLoaded)
+	prometheus.MustRegister(newSeverityCollector())
+	prometheus.MustRegister(newSummaryCollector())
+	prometheus.MustRegister(totalLabelOverflows)
+	prometheus.MustRegister(totalSeriesDropped)
+	prometheus.MustRegister(totalOutputErrors)
+	prometheus.MustRegister(queueDepth)
+	prometheus.MustRegister(queueAdds)
+	prometheus.MustRegister(queueLatency)
+	prometheus.MustRegister(queueWorkDuration)
+	prometheus.MustRegister(queueUnfinishedWork)
+	prometheus.MustRegister(queueLongestRunningProcessor)
+	prometheus.MustRegister(queueRetries)
+	prometheus.MustRegister(leader)
+	prometheus.MustRegister(shardInfo)
 }
 
-// Initialise our flags and start the metric webserver
+// Initialise our flags
 func init() {
-	configPath = flag.String("config", "", "Path to the configuration")
+	// Without leader election, every replica leads
+	leading.Store(true)
 
-	go func() {
-		if err := serveMetrics(3000); err != nil {
-			klog.ErrorS(err, "unable to serve metric")
-			os.Exit(1)
-		}
-	}()
+	configPath = flag.String("config", "", "Path to the configuration")
+	flag.StringVar(&serverOpts.Address, "listen-address", ":3000", "Address to serve metrics and health endpoints on")
+	flag.StringVar(&serverOpts.TLSCertFile, "tls-cert-file", "", "Path to a TLS certificate to serve with. Reloaded when changed")
+	flag.StringVar(&serverOpts.TLSKeyFile, "tls-key-file", "", "Path to the TLS certificate's private key")
+	flag.StringVar(&serverOpts.ClientCAFile, "client-ca-file", "", "Path to a CA bundle. If set, clients presenting a certificate signed by it may access metrics")
+	flag.StringVar(&serverOpts.AuthTokenFile, "auth-token-file", "", "Path to a file holding a bearer token. If set, clients presenting it may access metrics")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 25*time.Second, "How long to wait for in-flight evaluations, recorded events and the web server when shutting down")
 }
 
 func main() {
+	// Run a subcommand, if we've been given one
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
 	// Parse our flags and set up configuration
 	flag.Parse()
 	klog.InitFlags(nil)
-	conf = getConfig()
+	conf.Store(getConfig())
+	c := conf.Load()
+
+	// Refuse to start with policies that are missing, don't compile or don't define our queries
+	if problems := validateConfig(context.Background(), c, nil); len(problems) > 0 {
+		for _, err := range problems {
+			klog.ErrorS(err, "invalid config")
+		}
+		os.Exit(1)
+	}
+
+	// Prepare our query from the policy data once, up front
+	if _, err := policies.compile(context.Background(), c.Bundles); err != nil {
+		klog.ErrorS(err, "unable to prepare query from policy data")
+	}
+
+	// Start our web server
+	violationFamilies.setExtraLabels(c.Labels.Allow)
+	registerMetrics()
+	if err := violationFamilies.register(prometheus.DefaultRegisterer, c.Bundles); err != nil {
+		klog.ErrorS(err, "unable to register violation metrics")
+		os.Exit(1)
+	}
+	srv, err := newServer(serverOpts)
+	if err != nil {
+		klog.ErrorS(err, "unable to configure web server")
+		os.Exit(1)
+	}
+	go func() {
+		klog.InfoS("serving metrics", "address", srv.Addr, "tls", srv.TLSConfig != nil)
+		if err := serve(srv); err != nil && err != http.ErrServerClosed {
+			klog.ErrorS(err, "unable to serve metrics")
+			os.Exit(1)
+		}
+	}()
 
 	// Disable deprecation warning logs
 	rest.SetDefaultWarningHandler(rest.NoWarnings{})
 
-	// If we're inside the cluster, get our config from there.
-	// Otherwise, construct one from a kube config file
-	cfg, err := rest.InClusterConfig()
-	if kubeconfig := os.Getenv("KUBECONFIG"); kubeconfig != "" {
-		cfg, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
-	}
+	cfg, err := restConfig()
 	if err != nil {
 		klog.ErrorS(err, "unable to retrieve kube config")
 		os.Exit(1)
@@ -129,83 +226,280 @@ func main() {
 		klog.ErrorS(err, "unable to construct discovery client")
 	}
 
-	var toWatch []schema.GroupVersionResource
-	// Log if any of the provided objects aren't supported
-	if len(conf.Objects) > 0 {
-		for _, r := range conf.Objects {
-			if err := discovery.ServerSupportsVersion(discover, r.GroupVersion()); err != nil {
-				klog.ErrorS(err, "unsupported object")
-			}
+	toWatch := objectsToWatch(c, discover)
+
+	// Log where we're watching
+	switch {
+	case c.NamespaceSelector != "":
+		klog.InfoS("monitoring namespaces matching selector...", "selector", c.NamespaceSelector, "namespaces", c.Namespaces, "excluded", c.ExcludeNamespaces)
+	case len(c.Namespaces) > 0:
+		klog.InfoS("monitoring namespaces...", "namespaces", c.Namespaces, "excluded", c.ExcludeNamespaces)
+	default:
+		klog.InfoS("monitoring all namespaces...", "excluded", c.ExcludeNamespaces)
+	}
+
+	// Construct a dynamic informer from our client for each object outlined in our config,
+	// in each namespace we watch.
+	// Given a list of namespaces, each informer only lists objects in its namespace.
+	// Otherwise, informers list objects in all namespaces, and objects outside of the
+	// namespaces we watch are filtered out.
+	// Each informer only lists objects matching its selectors
+	// Add generic event handlers for each informer and start them
+	klog.InfoS("starting informers...")
+	var informers []cache.SharedIndexInformer
+	for _, ns := range informerNamespaces(c) {
+		for _, obj := range toWatch {
+			gvr := obj.GroupVersionResource
+			o := dynamicinformer.NewFilteredDynamicInformer(dc, gvr, ns, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}, obj.tweakListOptions)
+			klog.InfoS("watching "+strings.TrimPrefix(strings.Join([]string{gvr.Group, gvr.Version, gvr.Resource}, "/"), "/")+"...", "namespace", ns, "labelSelector", obj.LabelSelector, "fieldSelector", obj.FieldSelector)
+			o.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+				AddFunc:    func(obj interface{}) { onAdd(gvr, obj) },
+				DeleteFunc: func(obj interface{}) { onDelete(gvr, obj) },
+				UpdateFunc: func(oldObj, newObj interface{}) { onUpdate(gvr, oldObj, newObj) },
+			})
+			stores[informerKey{GVR: gvr, Namespace: ns}] = o.Informer().GetStore()
+			health.addInformer(informerName(gvr, ns), o.Informer())
+			informers = append(informers, o.Informer())
 		}
-		toWatch = conf.Objects
+	}
+
+	// Only evaluate our slice of objects, if sharding
+	if c.Sharding.Shards > 1 {
+		klog.InfoS("sharding objects", "index", *c.Sharding.Index, "shards", c.Sharding.Shards, "key", c.Sharding.Key)
+		shardInfo.WithLabelValues(strconv.Itoa(*c.Sharding.Index), strconv.Itoa(c.Sharding.Shards)).Set(1)
+	}
+
+	// If electing a leader, hold off evaluating until we've been elected
+	if c.LeaderElection.Enabled {
+		leading.Store(false)
 	} else {
-		toWatch, err = getRegisteredResources(discover)
+		leader.Set(1)
+	}
+
+	// Initiate a stop channel, closed when we're asked to terminate, and start our informers with it
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+	stopCh := ctx.Done()
+	defer utilruntime.HandleCrash()
+	for _, informer := range informers {
+		go informer.Run(stopCh)
+	}
+
+	// Track which namespaces match our selector, if we have one
+	if c.NamespaceSelector != "" {
+		watchNamespaceSelector(dc, stopCh)
+	}
+
+	// Construct a typed client for leader election & events, if we need one
+	var client kubernetes.Interface
+	if c.LeaderElection.Enabled || c.Events.Enabled {
+		client, err = kubernetes.NewForConfig(cfg)
 		if err != nil {
-			klog.ErrorS(err, "unable to retrieve list of registered resources")
+			klog.ErrorS(err, "unable to construct kubernetes client")
+			os.Exit(1)
 		}
 	}
 
-	// Construct a dynamic informer from our client.
-	// From this, we can grab informers for multiple kinds of kubernetes objects.
-	// If a 'namespace' value has been provided in the configuration, this factory
-	// will only lease informers for objects in that namespace. Otherwise (if 'namespace' is omitted
-	// or an empty string) provide informers for all namespaces
-	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dc, 0, conf.Namespace, nil)
+	// Record events against violating objects, if configured to
+	if c.Events.Enabled {
+		startEvents(client, c.Events)
+	}
 
-	// Log where we're watching
-	if conf.Namespace != "" {
-		klog.InfoS("monitoring '" + conf.Namespace + "' namespace...")
-	} else {
-		klog.InfoS("monitoring all namespaces...")
+	// Start our workers, which evaluate objects as they're queued
+	klog.InfoS("starting workers", "count", c.Workers)
+	for i := 0; i < c.Workers; i++ {
+		go wait.Until(runWorker, time.Second, stopCh)
 	}
 
-	// Grab an informer for each GVR outlined in our config
-	// Add generic event handlers for each informer and start them
-	klog.InfoS("starting informers...")
-	for _, obj := range toWatch {
-		o := factory.ForResource(obj)
-		klog.Infof("watching %s...", strings.TrimPrefix(strings.Join([]string{obj.Group, obj.Version, obj.Resource}, "/"), "/"))
-		o.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-			AddFunc:    onAdd,
-			DeleteFunc: onDelete,
-			UpdateFunc: onUpdate,
-		})
+	// Campaign for leadership, if configured to
+	if c.LeaderElection.Enabled {
+		go func() {
+			if err := runLeaderElection(ctx, client, c.LeaderElection); err != nil {
+				klog.ErrorS(err, "unable to run leader election")
+				os.Exit(1)
+			}
+		}()
 	}
 
-	// Initiate a stop channel and start our factory with it
-	stopCh := make(chan struct{})
-	defer close(stopCh)
-	defer utilruntime.HandleCrash()
-	factory.Start(stopCh)
+	// Track when our initial evaluation is done, for readiness
+	go health.waitForFirstPass(stopCh)
+
+	// Periodically reevaluate everything, if configured to
+	if c.ReevaluateInterval > 0 {
+		go reevaluatePeriodically(c.ReevaluateInterval, stopCh)
+	}
+
+	// Watch our config and policies, reloading them when they change on disk
+	w, err := newWatcher(time.Second, reload)
+	if err != nil {
+		klog.ErrorS(err, "unable to watch config and policies")
+	} else {
+		if err := w.watch(append([]string{viper.ConfigFileUsed()}, c.policyPaths()...)); err != nil {
+			klog.ErrorS(err, "unable to watch config and policies")
+		}
+		reloadWatcher = w
+		go w.run(stopCh)
+	}
 
 	// Wait for a stop
 	<-stopCh
 	klog.InfoS("shutting down informers")
+	shutdown(srv, shutdownTimeout)
 }
 
-// onAdd evaluates the object
-func onAdd(obj interface{}) {
-	r := obj.(*unstructured.Unstructured)
-	if conf.IgnoreChildren && hasOwnerRefs(r) {
-		return
+// shutdownGrace is how much of the shutdown timeout is kept back from draining evaluations,
+// for flushing recorded events and stopping the web server
+const shutdownGrace = 5 * time.Second
+
+// shutdown waits for in-flight evaluations to finish, then flushes recorded events and stops
+// the web server, all within the timeout. Draining may use all but shutdownGrace of it
+// (or half, for short timeouts), so what's left is always available for the rest
+func shutdown(srv *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	grace := shutdownGrace
+	if grace > timeout/2 {
+		grace = timeout / 2
 	}
-	kind := strings.ToLower(r.GetKind())
+	drainCtx, cancelDrain := context.WithTimeout(ctx, timeout-grace)
+	defer cancelDrain()
 
-	klog.InfoS("evaluating object", kind, klog.KObj(r))
+	klog.InfoS("draining evaluations", "timeout", timeout-grace)
+	drained := make(chan struct{})
+	go func() {
+		queue.ShutDownWithDrain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-drainCtx.Done():
+		klog.InfoS("timed out draining evaluations")
+	}
 
-	// Allows tests to wait for backgrounded go routine to complete before checking result
+	// Events are flushed while the web server stops, so neither holds up the other
+	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if err := evaluate(r, 0); err != nil {
-			klog.ErrorS(err, "unable to evaluate", kind, klog.KObj(r))
-		}
+		stopEvents(ctx)
 	}()
+
+	klog.InfoS("shutting down web server")
+	if err := srv.Shutdown(ctx); err != nil {
+		klog.ErrorS(err, "unable to shut down web server")
+	}
+	wg.Wait()
+
+	klog.Flush()
 }
 
-// onUpdate evaluates the object when a legitimate change is observed
-func onUpdate(oldObj, newObj interface{}) {
-	if conf.IgnoreChildren && hasOwnerRefs(newObj.(*unstructured.Unstructured)) {
+// reload reads the config & policies from disk again. If the policies have changed
+// the new query is swapped in and every cached object is reevaluated against it.
+// On failure, the existing config & policies are kept
+func reload() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	newConf, err := loadConfig()
+	if err != nil {
+		totalReloadErrors.Inc()
+		klog.ErrorS(err, "unable to reload config, keeping existing config")
+		return
+	}
+	if problems := validateConfig(context.Background(), newConf, nil); len(problems) > 0 {
+		totalReloadErrors.Inc()
+		for _, err := range problems {
+			klog.ErrorS(err, "invalid config, keeping existing config")
+		}
+		return
+	}
+
+	if changed := restartRequired(conf.Load(), newConf); len(changed) > 0 {
+		klog.InfoS("some config changes require a restart to take effect, keeping their current values", "options", changed)
+	}
+	keepRestartRequired(conf.Load(), newConf)
+
+	if err := violationFamilies.register(prometheus.DefaultRegisterer, newConf.Bundles); err != nil {
+		totalReloadErrors.Inc()
+		klog.ErrorS(err, "unable to register violation metrics, keeping existing config")
+		return
+	}
+
+	changed, err := policies.compile(context.Background(), newConf.Bundles)
+	if err != nil {
+		totalReloadErrors.Inc()
+		klog.ErrorS(err, "unable to prepare query from policy data, keeping existing policies")
+		return
+	}
+	conf.Store(newConf)
+
+	if reloadWatcher != nil {
+		if err := reloadWatcher.watch(append([]string{viper.ConfigFileUsed()}, newConf.policyPaths()...)); err != nil {
+			klog.ErrorS(err, "unable to watch config and policies")
+		}
+	}
+
+	klog.InfoS("config reloaded", "policiesChanged", changed)
+	reevaluateAll(0)
+}
+
+// reevaluateAll queues every object held in our informer caches for evaluation,
+// dropping any series for violations that no longer occur.
+// Objects are queued evenly across the spread duration, so a large cache doesn't
+// land on the workers all at once
+func reevaluateAll(spread time.Duration) {
+	if !leading.Load() {
+		return
+	}
+
+	var keys []objectKey
+	for ik, store := range stores {
+		for _, k := range store.ListKeys() {
+			namespace, name, err := cache.SplitMetaNamespaceKey(k)
+			if err != nil {
+				utilruntime.HandleError(err)
+				continue
+			}
+			keys = append(keys, objectKey{GVR: ik.GVR, Namespace: namespace, Name: name})
+		}
+	}
+
+	for i, key := range keys {
+		queue.AddAfter(key, spread*time.Duration(i)/time.Duration(len(keys)))
+	}
+}
+
+// reevaluatePeriodically reevaluates every cached object each interval until the
+// stop channel is closed. This catches violations that depend on time or external
+// data, which wouldn't otherwise be found until the object changes
+func reevaluatePeriodically(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			klog.InfoS("reevaluating all objects", "interval", interval)
+			reevaluateAll(interval)
+		}
+	}
+}
+
+// onAdd queues the object for evaluation
+func onAdd(gvr schema.GroupVersionResource, obj interface{}) {
+	r := obj.(*unstructured.Unstructured)
+	if conf.Load().IgnoreChildren && hasOwnerRefs(r) {
+		return
+	}
+	enqueue(gvr, r)
+}
+
+// onUpdate queues the object for reevaluation when a legitimate change is observed
+func onUpdate(gvr schema.GroupVersionResource, oldObj, newObj interface{}) {
+	if conf.Load().IgnoreChildren && hasOwnerRefs(newObj.(*unstructured.Unstructured)) {
 		return
 	}
 	objDiff, err := diff.Diff(oldObj, newObj)
@@ -215,43 +509,49 @@ func onUpdate(oldObj, newObj interface{}) {
 
 	// Without this, we see duplicate evaluations
 	if legitimateChange(objDiff) {
-		metricsRemoved := deleteAllMetricsForObject(oldObj.(*unstructured.Unstructured))
 		r := newObj.(*unstructured.Unstructured)
-		kind := strings.ToLower(r.GetKind())
-
-		klog.InfoS("change observed, reevaluating object", kind, klog.KObj(r))
-
-		// Allows tests to wait for backgrounded go routine to complete before checking result
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			if err := evaluate(r, metricsRemoved); err != nil {
-				klog.ErrorS(err, "unable to evaluate", kind, klog.KObj(r))
-			}
-		}()
+		klog.InfoS("change observed, reevaluating object", strings.ToLower(r.GetKind()), klog.KObj(r))
+		enqueue(gvr, r)
 	}
 }
 
-// onDelete deletes object associated metrics
-func onDelete(obj interface{}) {
-	r := obj.(*unstructured.Unstructured)
-	if conf.IgnoreChildren && hasOwnerRefs(r) {
+// onDelete queues the object, so that its series are removed by the worker which owns it.
+// Any evaluation of the object in progress finishes first, so can't reinstate them
+func onDelete(gvr schema.GroupVersionResource, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	r, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	if conf.Load().IgnoreChildren && hasOwnerRefs(r) {
 		return
 	}
 	klog.InfoS("object deleted", r.GetKind(), klog.KObj(r))
-	deleteAllMetricsForObject(r)
+	if leading.Load() {
+		queue.Add(objectKey{GVR: gvr, Namespace: r.GetNamespace(), Name: r.GetName()})
+	}
 }
 
 // deleteAllMetricsForObjects removes and series associated with a kubernetes object.
 // We do not check the result or truthiness intetntionally, as this function
 // may be called for an object with no associated metric.
 func deleteAllMetricsForObject(obj *unstructured.Unstructured) int {
-	return violation.DeletePartialMatch(prometheus.Labels{
-		"name":        obj.GetName(),
-		"namespace":   obj.GetNamespace(),
-		"kind":        obj.GetKind(),
-		"api_version": obj.GetAPIVersion(),
-	})
+	currentViolations.delete(obj)
+	return deleteViolations(objectLabels(obj))
+}
+
+// deleteMetricsForKey removes the series of an object that's gone from our informer caches
+func deleteMetricsForKey(key objectKey) {
+	if ref, ok := currentViolations.deleteKey(key); ok {
+		deleteViolations(prometheus.Labels{
+			"name":        ref.Name,
+			"namespace":   ref.Namespace,
+			"kind":        ref.Kind,
+			"api_version": ref.APIVersion,
+		})
+	}
 }
 
 // legitimateChange inspects a diff.Changelog and reports if its a collection of
@@ -263,7 +563,7 @@ func legitimateChange(cl diff.Changelog) bool {
 
 	var ignorable int
 	for _, v := range cl {
-		if v.Type == "update" && contains(conf.IgnoreDifferingPaths, strings.Join(v.Path, "/")) {
+		if v.Type == "update" && contains(conf.Load().IgnoreDifferingPaths, strings.Join(v.Path, "/")) {
 			ignorable++
 		}
 	}
@@ -296,79 +596,142 @@ func hasOwnerRefs(obj *unstructured.Unstructured) bool {
 	return false
 }
 
-// evaluate evaluates a kubernetes object against a rego policy
-func evaluate(obj *unstructured.Unstructured, previousViolations int) error {
-	// Get our context
-	ctx := context.Background()
+// queryViolations holds the violations a query found in an object
+type queryViolations struct {
+	query      queryConfig
+	violations []Violation
+}
 
-	// Prepare a rego object for use with our query & policy data
-	r := rego.New(rego.Query(conf.RegoQuery), rego.Load(conf.Policies, nil))
-	pq, err := r.PrepareForEval(ctx)
+// evaluateObject evaluates a kubernetes object, watched through the given resource,
+// against the prepared queries of the set's bundles applying to it, returning the
+// violations found by each query
+func evaluateObject(ctx context.Context, set *policySet, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) ([]queryViolations, error) {
+	results, err := set.eval(ctx, gvr, obj.GetKind(), obj.Object)
 	if err != nil {
-		klog.ErrorS(err, "unable to prepare query from policy data")
+		return nil, err
 	}
 
-	// Evaluate the kubernetes object against our prepared query
-	rs, err := pq.Eval(ctx, rego.EvalInput(obj.Object))
-	if err != nil {
-		klog.ErrorS(err, "unable to evaluate prepared query")
-	}
-
-	// Set up a var that indicates the presence of a violation
-	violations := 0
-
-	// Range the returned rego expressions in our resulting ruleset.
-	// Any violations will expose a Prometheus metric with labels providing object details
-	for _, r := range rs {
-		for _, e := range r.Expressions {
-			for _, i := range e.Value.([]interface{}) {
-				m := i.(map[string]interface{})
-
-				if _, ok := m["RuleSet"]; ok {
-					ruleSet = m["RuleSet"].(string) // Record globally so we can reference elsewhere
-				}
-
-				if _, ok := m["Data"]; ok {
-					data = m["Data"].(string) // Record globally so we can reference elsewhere
-				}
-
-				violations += 1
-				klog.InfoS("violation observed", strings.ToLower(obj.GetKind()), klog.KObj(obj), "ruleset", ruleSet, "data", data)
-				registerViolation(
-					m["Name"].(string),
-					m["Namespace"].(string),
-					m["Kind"].(string),
-					m["ApiVersion"].(string),
-					ruleSet,
-					data,
-				)
-			}
+	var found []queryViolations
+	for _, r := range results {
+		// Output that doesn't match our schema is a problem with the policy,
+		// not the object, so we report it and carry on with anything valid
+		violations, errs := decodeViolations(r.rs, obj, conf.Load().Severity)
+		for _, e := range errs {
+			totalOutputErrors.WithLabelValues(e.Policy, e.Reason).Inc()
+			klog.ErrorS(e.Err, "invalid policy output", "query", r.query.Name, "policy", e.Policy, "reason", e.Reason, "output", e.Output, strings.ToLower(obj.GetKind()), klog.KObj(obj))
 		}
+		found = append(found, queryViolations{query: r.query, violations: violations})
+	}
+
+	return found, nil
+}
+
+// evaluate evaluates a kubernetes object against our rego policies, replacing any
+// series previously exposed for it. If evaluation fails, the existing series are kept
+func evaluate(gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	// Evaluate the kubernetes object against our prepared queries
+	found, err := evaluateObject(context.Background(), policies, gvr, obj)
+	if err != nil {
+		return fmt.Errorf("unable to evaluate prepared query: %w", err)
 	}
 
-	// If this is an existing object and no violation is found
-	// we delete the associated metric (if there is one... if not
-	// we just silently ignore it)
-	resolvedViolations := previousViolations - violations
-	for resolvedViolations > 0 {
-		totalViolationsResolved.Inc()
-		resolvedViolations -= 1
+	// We may have stopped leading while evaluating, in which case our series have been
+	// dropped and we mustn't export any more
+	leadership.RLock()
+	defer leadership.RUnlock()
+	if !leading.Load() {
+		return nil
 	}
 
-	// Record the evaluation in the total counter
-	totalObjectEvaluations.Inc()
+	// Remove the object's existing series, counting the violations previously found
+	// by each query, along with any series from queries that no longer apply to it
+	previous := currentViolations.found(obj)
+	previousViolations := make(map[string]int)
+	for _, qv := range previous {
+		previousViolations[qv.query.Name] += len(qv.violations)
+	}
+	deleteViolations(objectLabels(obj))
+
+	// Only violations within our series limits are exported, the rest are counted
+	// so that the policy responsible can be found
+	// Without violation series there's nothing to limit
+	c := conf.Load()
+	limits := c.Limits
+	if c.DisableViolationSeries {
+		limits = limitsConfig{}
+	}
+	exported, dropped := currentViolations.record(gvr, obj, found, limits)
+	for _, d := range dropped {
+		klog.InfoS("violation series dropped, limit reached", strings.ToLower(obj.GetKind()), klog.KObj(obj), "query", d.query.Name, "ruleset", d.v.RuleSet, "limit", d.reason)
+		totalSeriesDropped.WithLabelValues(d.query.Name, d.reason).Inc()
+	}
+
+	for i, qv := range found {
+		// Any violations will expose a Prometheus metric with labels providing object details
+		for _, v := range exported[i].violations {
+			klog.InfoS("violation observed", strings.ToLower(obj.GetKind()), klog.KObj(obj), "query", qv.query.Name, "ruleset", v.RuleSet, "severity", v.Severity, "data", v.Data)
+			registerViolation(qv.query, v)
+		}
+
+		// If this is an existing object and no violation is found
+		// we delete the associated metric (if there is one... if not
+		// we just silently ignore it)
+		if resolvedViolations := previousViolations[qv.query.Name] - len(qv.violations); resolvedViolations > 0 {
+			totalViolationsResolved.WithLabelValues(qv.query.Name).Add(float64(resolvedViolations))
+		}
+
+		// Record the evaluation in the total counter
+		totalObjectEvaluations.WithLabelValues(qv.query.Name).Inc()
+	}
+	recordViolationEvents(obj, previous, found)
 
 	return nil
 }
 
-func registerViolation(name, namespace, kind, apiVersion, ruleset, data string) {
-	violation.WithLabelValues(name, namespace, kind, apiVersion, ruleset, data).Set(1)
+func registerViolation(query queryConfig, v Violation) {
+	if !conf.Load().DisableViolationSeries {
+		violationFamilies.get(query).WithLabelValues(violationFamilies.labelValues(query, v)...).Set(1)
+	}
 
 	// Record the violation in the total counter
-	totalViolations.Inc()
+	totalViolations.WithLabelValues(query.Name).Inc()
+}
+
+// objectsToWatch returns the configured objects, logging any which aren't supported.
+// Without any, every registered resource is watched with the default selectors
+func objectsToWatch(c *config, discover *discovery.DiscoveryClient) []objectConfig {
+	if len(c.Objects) > 0 {
+		for _, r := range c.Objects {
+			if err := discovery.ServerSupportsVersion(discover, r.GroupVersion()); err != nil {
+				klog.ErrorS(err, "unsupported object")
+			}
+		}
+		return c.Objects
+	}
+
+	var toWatch []objectConfig
+	gvrs, err := getRegisteredResources(discover)
+	if err != nil {
+		klog.ErrorS(err, "unable to retrieve list of registered resources")
+	}
+	for _, gvr := range gvrs {
+		toWatch = append(toWatch, objectConfig{GroupVersionResource: gvr, LabelSelector: c.LabelSelector, FieldSelector: c.FieldSelector})
+	}
+	return toWatch
+}
+
+// restConfig returns the config to reach the cluster with. Inside the cluster, we get our
+// config from there. Otherwise, we construct one from a kube config file
+func restConfig() (*rest.Config, error) {
+	cfg, err := rest.InClusterConfig()
+	if kubeconfig := os.Getenv("KUBECONFIG"); kubeconfig != "" {
+		cfg, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	return cfg, err
 }
 
 func getRegisteredResources(discover *discovery.DiscoveryClient) ([]schema.GroupVersionResource, error) {
+	c := conf.Load()
 	var r []schema.GroupVersionResource
 	_, resources, err := discover.ServerGroupsAndResources()
 	if err != nil {
@@ -378,16 +741,16 @@ func getRegisteredResources(discover *discovery.DiscoveryClient) ([]schema.Group
 	// Here, we reason about the sort of resources that should be watched based on verbs.
 	// The logic is such that - if it is a user-managed resource (and thus controllable) - it'll
 	// likely support said verbs.
-	// Along with this, if configured to monitor a specific namespace, we need to only discover
+	// Along with this, if configured to monitor specific namespaces, we need to only discover
 	// namespaced resources
 	var filtered []*metav1.APIResourceList
 	wantedVerbs := []string{
 		"create", "delete", "get", "list", "patch", "update", "watch",
 	}
-	if conf.Namespace != "" {
-		filtered = discovery.FilteredBy(namespacedImportantResource{Verbs: wantedVerbs, NotKind: conf.IgnoreKinds}, resources)
+	if c.namespaced() {
+		filtered = discovery.FilteredBy(namespacedImportantResource{Verbs: wantedVerbs, NotKind: c.IgnoreKinds}, resources)
 	} else {
-		filtered = discovery.FilteredBy(importantResource{Verbs: wantedVerbs, NotKind: conf.IgnoreKinds}, resources)
+		filtered = discovery.FilteredBy(importantResource{Verbs: wantedVerbs, NotKind: c.IgnoreKinds}, resources)
 	}
 
 	gvrs, err := discovery.GroupVersionResources(filtered)
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/open-policy-agent/opa/rego"
 	diff "github.com/r3labs/diff/v2"
 	"github.com/stretchr/testify/require"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/prometheus/client_golang/prometheus/testutil"
 )
@@ -16,12 +26,23 @@ import (
 var (
 	emptyMap        = make(map[string]string)
 	annotationsTeam = map[string]string{"company.domain/team": "test"}
+	testKey         = informerKey{GVR: testGVR}
+	testQuery       = queryConfig{Name: "default", Query: "data[_].main"}
+	testGVR         = schema.GroupVersionResource{Group: "extensions", Version: "v1beta1", Resource: "deployments"}
 )
 
 func initConfig() {
 	cp := "example/config/config.yaml"
 	configPath = &cp
-	conf = getConfig()
+	c := getConfig()
+
+	// Our test objects live in namespaces of their own, outside of the example's
+	c.Namespace = ""
+	c.Namespaces = nil
+	conf.Store(c)
+	if _, err := policies.compile(context.Background(), conf.Load().Bundles); err != nil {
+		panic(err)
+	}
 }
 
 func TestContains(t *testing.T) {
@@ -103,22 +124,19 @@ func TestHasOwnerRefs(t *testing.T) {
 
 func TestEvaluate(t *testing.T) {
 	tests := map[string]struct {
-		obj                *unstructured.Unstructured
-		previousViolations int
-		resetCount         bool // Should the violation counter metric be reset after the test run.
-		want               int
+		obj        *unstructured.Unstructured
+		resetCount bool // Should the violation counter metric be reset after the test run.
+		want       int
 	}{
 		"success": {
-			obj:                newUnstructured("extensions/v1beta1", "deployment", "testEvaluate", "testEvaluate", "1", annotationsTeam, getChartLabels("4.0.0"), false),
-			previousViolations: 0,
-			resetCount:         true,
-			want:               0,
+			obj:        newUnstructured("extensions/v1beta1", "deployment", "testEvaluate", "testEvaluate", "1", annotationsTeam, getChartLabels("4.0.0"), false),
+			resetCount: true,
+			want:       0,
 		},
 		"failure": {
-			obj:                newUnstructured("extensions/v1beta1", "deployment", "testEvaluate", "testEvaluate", "1", annotationsTeam, getChartLabels("3.0.0"), false),
-			previousViolations: 0,
-			resetCount:         true,
-			want:               1,
+			obj:        newUnstructured("extensions/v1beta1", "deployment", "testEvaluate", "testEvaluate", "1", annotationsTeam, getChartLabels("3.0.0"), false),
+			resetCount: true,
+			want:       1,
 		},
 	}
 
@@ -126,7 +144,7 @@ func TestEvaluate(t *testing.T) {
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			evaluate(tc.obj, tc.previousViolations)
+			require.NoError(t, evaluate(testGVR, tc.obj))
 
 			got := getNumberOfViolations()
 
@@ -140,6 +158,60 @@ func TestEvaluate(t *testing.T) {
 	}
 }
 
+func TestEvaluateError(t *testing.T) {
+	initConfig()
+
+	obj := newUnstructured("extensions/v1beta1", "deployment", "testEvaluate", "testEvaluate", "1", annotationsTeam, getChartLabels("3.0.0"), false)
+	require.NoError(t, evaluate(testGVR, obj))
+
+	// Without any compiled policies, evaluation should fail
+	// and leave the existing series in place
+	compiled := policies
+	policies = newPolicySet()
+	defer func() { policies = compiled }()
+
+	require.ErrorIs(t, evaluate(testGVR, obj), errNoQuery)
+	got := getNumberOfViolations()
+	violation.Reset()
+
+	require.Equal(t, 1, got)
+}
+
+// TestEvaluateConcurrent should be run with '-race' to catch
+// any state shared between evaluations
+func TestEvaluateConcurrent(t *testing.T) {
+	initConfig()
+
+	var wg sync.WaitGroup
+	objects := 20
+	for i := 0; i < objects; i++ {
+		// Alternate between violating & compliant objects, so the result of
+		// one evaluation can't leak into another
+		vers := "3.0.0"
+		if i%2 == 0 {
+			vers = "4.0.0"
+		}
+		obj := newUnstructured("extensions/v1beta1", "deployment", "test", fmt.Sprintf("test-%d", i), "1", annotationsTeam, getChartLabels(vers), false)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found, err := evaluateObject(context.Background(), policies, testGVR, obj)
+			require.NoError(t, err)
+			require.Len(t, found, 1)
+			violations := found[0].violations
+			if vers == "4.0.0" {
+				require.Empty(t, violations)
+				return
+			}
+			require.Len(t, violations, 1)
+			require.Equal(t, obj.GetName(), violations[0].Name)
+			require.Equal(t, "test", violations[0].Data)
+		}()
+	}
+	wg.Wait()
+}
+
 func TestOnAdd(t *testing.T) {
 	tests := map[string]struct {
 		obj        *unstructured.Unstructured
@@ -168,8 +240,9 @@ func TestOnAdd(t *testing.T) {
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			onAdd(tc.obj)
-			wg.Wait()
+			storeObject(t, tc.obj)
+			onAdd(testGVR, tc.obj)
+			processQueue()
 			got := getNumberOfViolations()
 
 			if tc.resetCount {
@@ -219,11 +292,13 @@ func TestOnUpdate(t *testing.T) {
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			onAdd(tc.oldObj)
-			wg.Wait()
+			storeObject(t, tc.oldObj)
+			onAdd(testGVR, tc.oldObj)
+			processQueue()
 
-			onUpdate(tc.oldObj, tc.newObj)
-			wg.Wait()
+			storeObject(t, tc.newObj)
+			onUpdate(testGVR, tc.oldObj, tc.newObj)
+			processQueue()
 			got := getNumberOfViolations()
 
 			if tc.resetCount {
@@ -251,11 +326,13 @@ func TestOnDelete(t *testing.T) {
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			onAdd(tc.obj)
-			wg.Wait()
+			storeObject(t, tc.obj)
+			onAdd(testGVR, tc.obj)
+			processQueue()
 
-			onDelete(tc.obj)
-			wg.Wait()
+			require.NoError(t, stores[testKey].Delete(tc.obj))
+			onDelete(testGVR, tc.obj)
+			processQueue()
 
 			got := getNumberOfViolations()
 
@@ -294,14 +371,14 @@ func TestDeleteAllMetricsForObject(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			metricsToCreate := tc.metricCount
 			for metricsToCreate != 0 {
-				registerViolation(
-					tc.obj.GetName(),
-					tc.obj.GetNamespace(),
-					tc.obj.GetKind(),
-					tc.obj.GetAPIVersion(),
-					fmt.Sprintf("ruleset-%d", metricsToCreate),
-					fmt.Sprintf("data-%d", metricsToCreate),
-				)
+				registerViolation(testQuery, Violation{
+					Name:       tc.obj.GetName(),
+					Namespace:  tc.obj.GetNamespace(),
+					Kind:       tc.obj.GetKind(),
+					ApiVersion: tc.obj.GetAPIVersion(),
+					RuleSet:    fmt.Sprintf("ruleset-%d", metricsToCreate),
+					Data:       fmt.Sprintf("data-%d", metricsToCreate),
+				})
 				metricsToCreate -= 1
 			}
 
@@ -324,22 +401,22 @@ func TestDeleteAllMetricsForObject(t *testing.T) {
 		i := 0
 		metricsToCreate := 3
 		for i < metricsToCreate {
-			registerViolation(
-				objToDelete.GetName(),
-				objToDelete.GetNamespace(),
-				objToDelete.GetKind(),
-				objToDelete.GetAPIVersion(),
-				fmt.Sprintf("ruleset-%d", i),
-				fmt.Sprintf("data-%d", i),
-			)
-			registerViolation(
-				otherObj.GetName(),
-				otherObj.GetNamespace(),
-				otherObj.GetKind(),
-				otherObj.GetAPIVersion(),
-				fmt.Sprintf("ruleset-%d", i),
-				fmt.Sprintf("data-%d", i),
-			)
+			registerViolation(testQuery, Violation{
+				Name:       objToDelete.GetName(),
+				Namespace:  objToDelete.GetNamespace(),
+				Kind:       objToDelete.GetKind(),
+				ApiVersion: objToDelete.GetAPIVersion(),
+				RuleSet:    fmt.Sprintf("ruleset-%d", i),
+				Data:       fmt.Sprintf("data-%d", i),
+			})
+			registerViolation(testQuery, Violation{
+				Name:       otherObj.GetName(),
+				Namespace:  otherObj.GetNamespace(),
+				Kind:       otherObj.GetKind(),
+				ApiVersion: otherObj.GetAPIVersion(),
+				RuleSet:    fmt.Sprintf("ruleset-%d", i),
+				Data:       fmt.Sprintf("data-%d", i),
+			})
 			i += 1
 		}
 
@@ -350,6 +427,203 @@ func TestDeleteAllMetricsForObject(t *testing.T) {
 	})
 }
 
+func TestReevaluateAll(t *testing.T) {
+	initConfig()
+
+	obj := newUnstructured("extensions/v1beta1", "deployment", "test", "test", "1", annotationsTeam, getChartLabels("3.0.0"), false)
+	storeObject(t, obj)
+
+	// A series for a rule which no longer exists should be dropped
+	registerViolation(testQuery, objectViolation(obj, "removed rule", "medium"))
+
+	reevaluateAll(0)
+	processQueue()
+	got := getNumberOfViolations()
+	violation.Reset()
+
+	require.Equal(t, 1, got)
+}
+
+func TestReevaluateAllSpread(t *testing.T) {
+	initConfig()
+	stores[testKey] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+	storeObject(t, newUnstructured("extensions/v1beta1", "deployment", "test", "first", "1", annotationsTeam, getChartLabels("4.0.0"), false))
+	storeObject(t, newUnstructured("extensions/v1beta1", "deployment", "test", "second", "1", annotationsTeam, getChartLabels("4.0.0"), false))
+
+	// Only the first object should be queued straight away,
+	// the rest are spread across the duration
+	reevaluateAll(200 * time.Millisecond)
+	require.Equal(t, 1, queue.Len())
+	require.Eventually(t, func() bool { return queue.Len() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	processQueue()
+	violation.Reset()
+}
+
+func TestReload(t *testing.T) {
+	initConfig()
+	defer initConfig()
+
+	cached := stores
+	defer func() { stores = cached }()
+	stores = map[informerKey]cache.Store{testKey: cache.NewStore(cache.MetaNamespaceKeyFunc)}
+	storeObject(t, newUnstructured("extensions/v1beta1", "deployment", "test", "test", "1", annotationsTeam, getChartLabels("3.0.0"), false))
+
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(policy, []byte(fmt.Sprintf(testPolicy, "old")), 0o644))
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf("policies:\n  - %s\n", dir)), 0o644))
+	configPath = &path
+
+	// ruleSets returns the rulesets our policies currently find
+	ruleSets := func() []string {
+		results, err := policies.eval(context.Background(), testGVR, "Deployment", map[string]interface{}{"bad": true})
+		require.NoError(t, err)
+		var got []string
+		for _, r := range results {
+			for _, v := range r.rs[0].Expressions[0].Value.([]interface{}) {
+				got = append(got, v.(map[string]interface{})["RuleSet"].(string))
+			}
+		}
+		return got
+	}
+
+	reload()
+	processQueue()
+	require.Equal(t, []string{"old"}, ruleSets())
+
+	// A failed reload keeps the existing config & policies
+	loaded := conf.Load()
+	reloadErrors := testutil.ToFloat64(totalReloadErrors)
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf("policies:\n  - %s\nregoQuery: data.test.undefined\n", dir)), 0o644))
+	reload()
+	require.Equal(t, reloadErrors+1, testutil.ToFloat64(totalReloadErrors), "query refers to an undefined rule")
+	require.Same(t, loaded, conf.Load())
+	require.Equal(t, []string{"old"}, ruleSets())
+	require.Zero(t, queue.Len())
+
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf("policies:\n  - %s\n", dir)), 0o644))
+	reloadErrors = testutil.ToFloat64(totalReloadErrors)
+	require.NoError(t, os.WriteFile(policy, []byte("package test\nmain[output] {"), 0o644))
+	reload()
+	require.Equal(t, reloadErrors+1, testutil.ToFloat64(totalReloadErrors))
+	require.Same(t, loaded, conf.Load())
+	require.Equal(t, []string{"old"}, ruleSets())
+	require.Zero(t, queue.Len())
+
+	// A successful reload swaps in the new config & policies and reevaluates every object
+	require.NoError(t, os.WriteFile(policy, []byte(fmt.Sprintf(testPolicy, "new")), 0o644))
+	reload()
+	require.Equal(t, reloadErrors+1, testutil.ToFloat64(totalReloadErrors))
+	require.NotSame(t, loaded, conf.Load())
+	require.Equal(t, []string{"new"}, ruleSets())
+	require.Equal(t, 1, queue.Len())
+	processQueue()
+}
+
+func TestShutdown(t *testing.T) {
+	initConfig()
+
+	running := queue
+	queue = newQueue()
+	defer func() { queue = running }()
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	// Objects still queued at shutdown shouldn't hold it up
+	obj := newUnstructured("extensions/v1beta1", "deployment", "test", "test", "1", annotationsTeam, getChartLabels("3.0.0"), false)
+	storeObject(t, obj)
+	enqueue(testGVR, obj)
+
+	done := make(chan struct{})
+	go func() {
+		for processNextItem() {
+		}
+		close(done)
+	}()
+
+	shutdown(srv.Config, time.Second)
+	require.True(t, queue.ShuttingDown())
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker didn't stop after shutdown")
+	}
+	violation.Reset()
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	running := queue
+	queue = newQueue()
+	defer func() { queue = running }()
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	// An evaluation that never finishes can't hold shutdown past its timeout
+	queue.Add(objectKey{GVR: testGVR, Namespace: "test", Name: "stuck"})
+	item, _ := queue.Get()
+	defer queue.Done(item)
+
+	start := time.Now()
+	shutdown(srv.Config, time.Second)
+	require.Less(t, time.Since(start), 1500*time.Millisecond)
+}
+
+func BenchmarkEvaluate(b *testing.B) {
+	initConfig()
+	obj := newUnstructured("extensions/v1beta1", "deployment", "test", "test", "1", annotationsTeam, getChartLabels("3.0.0"), false)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		evaluate(testGVR, obj)
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "evals/s")
+
+	violation.Reset()
+}
+
+// BenchmarkEvaluateUnprepared measures evaluation when the query is prepared
+// from the policy files for every object, for comparison with BenchmarkEvaluate
+func BenchmarkEvaluateUnprepared(b *testing.B) {
+	initConfig()
+	obj := newUnstructured("extensions/v1beta1", "deployment", "test", "test", "1", annotationsTeam, getChartLabels("3.0.0"), false)
+	ctx := context.Background()
+	bundle := conf.Load().Bundles[0]
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pq, err := prepareQuery(ctx, bundle.Queries[0].Query, bundle.Policies)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := pq.Eval(ctx, rego.EvalInput(obj.Object)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "evals/s")
+}
+
+// storeObject adds or updates an object in the test resource's store,
+// as an informer would before calling its event handlers
+func storeObject(t *testing.T, obj *unstructured.Unstructured) {
+	if _, ok := stores[testKey]; !ok {
+		stores[testKey] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	}
+	require.NoError(t, stores[testKey].Update(obj))
+}
+
+// processQueue evaluates everything in the queue, returning once it's empty
+func processQueue() {
+	for queue.Len() > 0 {
+		processNextItem()
+	}
+}
+
 func getNumberOfViolations() int {
 	return testutil.CollectAndCount(violation)
 }
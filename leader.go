@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	klog "k8s.io/klog/v2"
+)
+
+// serviceAccountNamespace holds the namespace we're running in, when inside a cluster
+const serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+var (
+	// Whether this replica should evaluate objects and export violations.
+	// Without leader election, every replica leads
+	leading atomic.Bool
+
+	// Held while an evaluation exports its violations, and while we stop leading,
+	// so a follower can't export violations once it has dropped its series
+	leadership sync.RWMutex
+
+	leader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "kove_leader",
+			Help: "Whether this replica is the leader, evaluating objects and exporting violations.",
+		},
+	)
+)
+
+// runLeaderElection campaigns for leadership until the context is cancelled.
+// While leading, every cached object is evaluated and violations are exported.
+// On losing leadership, our violation series are dropped so that only the leader
+// exports them, and we campaign again. Our informers keep running throughout, so
+// we're ready to take over
+func runLeaderElection(ctx context.Context, client kubernetes.Interface, le leaderElectionConfig) error {
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		identity = hostname
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      le.LeaseName,
+			Namespace: le.LeaseNamespace,
+		},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   le.LeaseDuration,
+		RenewDeadline:   le.RenewDeadline,
+		RetryPeriod:     le.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            le.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				klog.InfoS("started leading", "identity", identity)
+				startLeading()
+			},
+			OnStoppedLeading: func() {
+				klog.InfoS("stopped leading", "identity", identity)
+				stopLeading()
+			},
+			OnNewLeader: func(current string) {
+				if current != identity {
+					klog.InfoS("following leader", "leader", current)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+	return nil
+}
+
+// startLeading marks this replica as the leader and evaluates every cached object
+func startLeading() {
+	leading.Store(true)
+	leader.Set(1)
+	reevaluateAll(0)
+}
+
+// stopLeading marks this replica as a follower and drops our violation series
+func stopLeading() {
+	leadership.Lock()
+	leading.Store(false)
+	resetViolations()
+	leadership.Unlock()
+	leader.Set(0)
+}
+
+// defaultLeaseNamespace returns the namespace we're running in,
+// falling back to the default namespace outside of a cluster
+func defaultLeaseNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if b, err := os.ReadFile(serviceAccountNamespace); err == nil {
+		if ns := strings.TrimSpace(string(b)); ns != "" {
+			return ns
+		}
+	}
+	return "default"
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestLeadership(t *testing.T) {
+	initConfig()
+	stores[testKey] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	defer startLeading()
+
+	obj := newUnstructured("extensions/v1beta1", "deployment", "test", "test", "1", annotationsTeam, getChartLabels("3.0.0"), false)
+	storeObject(t, obj)
+	enqueue(testGVR, obj)
+	processQueue()
+	require.Equal(t, 1, getNumberOfViolations())
+
+	// Followers drop their series and don't queue anything
+	stopLeading()
+	require.Equal(t, 0, getNumberOfViolations())
+	require.Equal(t, float64(0), testutil.ToFloat64(leader))
+
+	enqueue(testGVR, obj)
+	require.Equal(t, 0, queue.Len())
+
+	// Evaluations which were underway when we stopped leading export nothing
+	require.NoError(t, evaluate(testGVR, obj))
+	require.Equal(t, 0, getNumberOfViolations())
+	require.Nil(t, currentViolations.found(obj))
+
+	// Once elected, everything cached is evaluated
+	startLeading()
+	require.Equal(t, float64(1), testutil.ToFloat64(leader))
+	processQueue()
+	require.Equal(t, 1, getNumberOfViolations())
+
+	violation.Reset()
+}
+
+func TestRunLeaderElection(t *testing.T) {
+	initConfig()
+	stores[testKey] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	leading.Store(false)
+	defer startLeading()
+
+	le := conf.Load().LeaderElection
+	le.LeaseDuration, le.RenewDeadline, le.RetryPeriod = time.Second, 500*time.Millisecond, 100*time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- runLeaderElection(ctx, fake.NewSimpleClientset(), le) }()
+
+	require.Eventually(t, leading.Load, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+	require.False(t, leading.Load())
+}
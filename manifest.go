@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// manifestExtensions are the extensions of files read from directories of manifests
+var manifestExtensions = []string{".yaml", ".yml", ".json"}
+
+// manifest is an object read from a file, rather than the cluster
+type manifest struct {
+	// The file the object was read from, or "-" for stdin
+	source string
+	obj    *unstructured.Unstructured
+}
+
+// readManifests reads the objects described by YAML or JSON manifests at the given paths.
+// Paths may be files of several documents, directories of them, or "-" for stdin.
+// Lists, such as the output of `kubectl get -o yaml`, are read as their items
+func readManifests(paths []string, stdin io.Reader) ([]manifest, error) {
+	var manifests []manifest
+	for _, path := range paths {
+		if path == "-" {
+			m, err := decodeManifests(path, stdin)
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, m...)
+			continue
+		}
+
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// Files in directories are only read if they look like manifests,
+			// but files given explicitly are always read
+			if d.IsDir() || (p != path && !contains(manifestExtensions, strings.ToLower(filepath.Ext(p)))) {
+				return nil
+			}
+
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			m, err := decodeManifests(p, f)
+			if err != nil {
+				return err
+			}
+			manifests = append(manifests, m...)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to read manifests: %w", err)
+		}
+	}
+	return manifests, nil
+}
+
+// decodeManifests decodes every document of a YAML or JSON stream
+func decodeManifests(source string, r io.Reader) ([]manifest, error) {
+	var manifests []manifest
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for i := 0; ; i++ {
+		var doc map[string]interface{}
+		if err := decoder.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				return manifests, nil
+			}
+			return nil, fmt.Errorf("%s: document %d: %w", source, i, err)
+		}
+		// Empty documents, such as those between consecutive separators, are skipped
+		if len(doc) == 0 {
+			continue
+		}
+
+		obj := &unstructured.Unstructured{Object: doc}
+		if obj.GetKind() == "" {
+			return nil, fmt.Errorf("%s: document %d: object has no kind", source, i)
+		}
+		if !obj.IsList() {
+			manifests = append(manifests, manifest{source: source, obj: obj})
+			continue
+		}
+
+		err := obj.EachListItem(func(item runtime.Object) error {
+			manifests = append(manifests, manifest{source: source, obj: item.(*unstructured.Unstructured)})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: document %d: %w", source, i, err)
+		}
+	}
+}
+
+// guessResource returns the resource an object is likely served as. Without discovery,
+// this lets bundles bound to particular objects apply to manifests
+func guessResource(obj *unstructured.Unstructured) schema.GroupVersionResource {
+	gvr, _ := meta.UnsafeGuessKindToResource(obj.GroupVersionKind())
+	return gvr
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestReadManifests(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"deployments.yaml": `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: first
+---
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: second
+`,
+		"list.json": `{"apiVersion": "v1", "kind": "List", "items": [{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "third"}}]}`,
+		"README.md": "Not a manifest",
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	tests := map[string]struct {
+		paths   []string
+		stdin   string
+		want    []string
+		wantErr bool
+	}{
+		"directory": {
+			paths: []string{dir},
+			want:  []string{"first", "second", "third"},
+		},
+		"file": {
+			paths: []string{filepath.Join(dir, "list.json")},
+			want:  []string{"third"},
+		},
+		"stdin": {
+			paths: []string{"-"},
+			stdin: files["deployments.yaml"],
+			want:  []string{"first", "second"},
+		},
+		"missing kind": {
+			paths:   []string{"-"},
+			stdin:   "apiVersion: v1\nmetadata:\n  name: test\n",
+			wantErr: true,
+		},
+		"invalid": {
+			paths:   []string{filepath.Join(dir, "README.md")},
+			wantErr: true,
+		},
+		"missing": {
+			paths:   []string{filepath.Join(dir, "missing.yaml")},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			manifests, err := readManifests(tc.paths, strings.NewReader(tc.stdin))
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			var names []string
+			for _, m := range manifests {
+				names = append(names, m.obj.GetName())
+			}
+			require.Equal(t, tc.want, names)
+		})
+	}
+}
+
+func TestGuessResource(t *testing.T) {
+	obj := newUnstructured("apps/v1", "Deployment", "test", "test", "1", emptyMap, emptyMap, false)
+	require.Equal(t, schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}, guessResource(obj))
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// violationLabels are the labels of every metric family violations are exported into
+var violationLabels = []string{"name", "namespace", "kind", "api_version", "ruleset", "data", "severity", "query"}
+
+// labelOverflow replaces the values of extra labels once they've had too many distinct values
+const labelOverflow = "_overflow"
+
+var (
+	// violationFamilies holds the metric families violations are exported into
+	violationFamilies = &families{vecs: make(map[string]*prometheus.GaugeVec)}
+
+	// labelValues guards the cardinality of the extra labels of violations
+	labelValues = newLabelGuard()
+
+	totalLabelOverflows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "opa_policy_label_overflows_total",
+			Help: "Total count of label values replaced as the label had too many distinct values.",
+		},
+		[]string{"label"},
+	)
+
+	totalSeriesDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "opa_policy_violation_series_dropped_total",
+			Help: "Total count of policy violations not exported as a series limit was reached.",
+		},
+		[]string{"query", "reason"},
+	)
+)
+
+// families holds the metric families of queries exporting violations under a
+// metric name of their own, by metric name
+type families struct {
+	mu   sync.RWMutex
+	vecs map[string]*prometheus.GaugeVec
+
+	// Labels from policy output exported alongside violationLabels
+	extra []string
+}
+
+// newViolationVec returns a metric family for violations with the given extra labels
+func newViolationVec(name string, extra []string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: name,
+			Help: "Kubernetes object violating policy evaluation.",
+		},
+		append(append([]string{}, violationLabels...), extra...),
+	)
+}
+
+// setExtraLabels sets the labels from policy output that violations are exported with.
+// As the labels of a metric are fixed, this must be done before any are registered
+func (f *families) setExtraLabels(extra []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.extra = extra
+	violation = newViolationVec("opa_policy_violation", extra)
+}
+
+// labelValues returns the values of a violation's series, in the order of its family's labels
+func (f *families) labelValues(query queryConfig, v Violation) []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	data := truncateData(v.Data, conf.Load().Limits.MaxDataLength)
+	values := []string{v.Name, v.Namespace, v.Kind, v.ApiVersion, v.RuleSet, data, v.Severity, query.Name}
+	ref := objectRef{APIVersion: v.ApiVersion, Kind: v.Kind, Namespace: v.Namespace, Name: v.Name}
+	for _, l := range f.extra {
+		values = append(values, labelValues.value(ref, l, v.Labels[l]))
+	}
+	return values
+}
+
+// register creates & registers a metric family for each query with a metric name of
+// its own. Families are never unregistered, as series may still be exported into them
+func (f *families) register(reg prometheus.Registerer, bundles []bundleConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, b := range bundles {
+		for _, q := range b.Queries {
+			if q.Metric == "" || q.Metric == "opa_policy_violation" {
+				continue
+			}
+			if _, ok := f.vecs[q.Metric]; ok {
+				continue
+			}
+
+			vec := newViolationVec(q.Metric, f.extra)
+			if err := reg.Register(vec); err != nil {
+				return fmt.Errorf("unable to register metric %q for query %q: %w", q.Metric, q.Name, err)
+			}
+			f.vecs[q.Metric] = vec
+		}
+	}
+	return nil
+}
+
+// get returns the metric family a query's violations are exported into
+func (f *families) get(q queryConfig) *prometheus.GaugeVec {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if vec, ok := f.vecs[q.Metric]; ok {
+		return vec
+	}
+	return violation
+}
+
+// all returns every metric family violations are exported into
+func (f *families) all() []*prometheus.GaugeVec {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	vecs := []*prometheus.GaugeVec{violation}
+	for _, vec := range f.vecs {
+		vecs = append(vecs, vec)
+	}
+	return vecs
+}
+
+// deleteViolations removes the violation series matching the given labels from
+// every family, returning the number removed
+func deleteViolations(labels prometheus.Labels) int {
+	deleted := 0
+	for _, vec := range violationFamilies.all() {
+		deleted += vec.DeletePartialMatch(labels)
+	}
+	labelValues.release(labels)
+	return deleted
+}
+
+// resetViolations removes every violation series
+func resetViolations() {
+	for _, vec := range violationFamilies.all() {
+		vec.Reset()
+	}
+	labelValues.reset()
+	currentViolations.reset()
+}
+
+// objectLabels returns the labels identifying an object's violation series
+func objectLabels(obj *unstructured.Unstructured) prometheus.Labels {
+	return prometheus.Labels{
+		"name":        obj.GetName(),
+		"namespace":   obj.GetNamespace(),
+		"kind":        obj.GetKind(),
+		"api_version": obj.GetAPIVersion(),
+	}
+}
+
+// truncateData shortens data longer than max bytes, suffixing it with a hash of the
+// full value so that distinct values remain distinct
+func truncateData(data string, max int) string {
+	if max <= 0 || len(data) <= max {
+		return data
+	}
+
+	sum := sha256.Sum256([]byte(data))
+	suffix := "~" + hex.EncodeToString(sum[:])[:8]
+	cut := max - len(suffix)
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(data[cut]) {
+		cut--
+	}
+	return data[:cut] + suffix
+}
+
+// labelGuard limits the number of distinct values of each extra label across the
+// violation series currently exported
+type labelGuard struct {
+	mu sync.Mutex
+
+	// The number of series holding each value of each label
+	refs map[string]map[string]int
+
+	// The label values held by the series of each object
+	held map[objectRef][]heldValue
+}
+
+// heldValue is the value of a label held by a series
+type heldValue struct {
+	label, value string
+}
+
+// newLabelGuard returns a guard with no values
+func newLabelGuard() *labelGuard {
+	return &labelGuard{
+		refs: make(map[string]map[string]int),
+		held: make(map[objectRef][]heldValue),
+	}
+}
+
+// value returns the value to export for a label of a series of the given object.
+// Once a label's series hold the configured number of distinct values, any new
+// values are replaced until series holding other values are released
+func (g *labelGuard) value(ref objectRef, label, value string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	refs, ok := g.refs[label]
+	if !ok {
+		refs = make(map[string]int)
+		g.refs[label] = refs
+	}
+	if refs[value] == 0 && len(refs) >= conf.Load().Labels.MaxValues {
+		totalLabelOverflows.WithLabelValues(label).Inc()
+		return labelOverflow
+	}
+	refs[value]++
+	g.held[ref] = append(g.held[ref], heldValue{label: label, value: value})
+	return value
+}
+
+// release releases the values held by the series of objects matching the given labels,
+// as used to delete their series
+func (g *labelGuard) release(labels prometheus.Labels) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Series are usually deleted an object at a time, so avoid walking every object
+	if ref, ok := labelsRef(labels); ok {
+		g.releaseObject(ref)
+		return
+	}
+	for ref := range g.held {
+		if refMatches(ref, labels) {
+			g.releaseObject(ref)
+		}
+	}
+}
+
+// releaseObject releases the values held by the series of an object.
+// The caller must hold the lock
+func (g *labelGuard) releaseObject(ref objectRef) {
+	for _, h := range g.held[ref] {
+		refs := g.refs[h.label]
+		if refs[h.value]--; refs[h.value] <= 0 {
+			delete(refs, h.value)
+		}
+	}
+	delete(g.held, ref)
+}
+
+// reset releases every value
+func (g *labelGuard) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.refs = make(map[string]map[string]int)
+	g.held = make(map[objectRef][]heldValue)
+}
+
+// labelsRef returns the object identified by labels, if they're exactly those of objectLabels
+func labelsRef(labels prometheus.Labels) (objectRef, bool) {
+	if len(labels) != 4 {
+		return objectRef{}, false
+	}
+	for _, l := range violationLabels[:4] {
+		if _, ok := labels[l]; !ok {
+			return objectRef{}, false
+		}
+	}
+	return objectRef{APIVersion: labels["api_version"], Kind: labels["kind"], Namespace: labels["namespace"], Name: labels["name"]}, true
+}
+
+// refMatches reports whether an object's series match labels. Only the labels identifying
+// objects are known, so any other label matches nothing, keeping values held rather than
+// risk exceeding the limit
+func refMatches(ref objectRef, labels prometheus.Labels) bool {
+	for l, v := range labels {
+		var got string
+		switch l {
+		case "name":
+			got = ref.Name
+		case "namespace":
+			got = ref.Namespace
+		case "kind":
+			got = ref.Kind
+		case "api_version":
+			got = ref.APIVersion
+		default:
+			return false
+		}
+		if v != got {
+			return false
+		}
+	}
+	return true
+}
+
+// severityCollector exports the number of current violations by namespace & severity
+type severityCollector struct {
+	desc *prometheus.Desc
+}
+
+// newSeverityCollector returns a collector for opa_policy_violations_by_severity
+func newSeverityCollector() *severityCollector {
+	return &severityCollector{
+		desc: prometheus.NewDesc(
+			"opa_policy_violations_by_severity",
+			"Current number of policy violations by namespace and severity.",
+			[]string{"namespace", "severity"},
+			nil,
+		),
+	}
+}
+
+func (c *severityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *severityCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := make(map[[2]string]int)
+	currentViolations.each(func(_ queryConfig, v Violation) {
+		counts[[2]string{v.Namespace, v.Severity}]++
+	})
+	for k, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), k[0], k[1])
+	}
+}
+
+// summaryCollector exports the number of current violations & evaluated objects,
+// so dashboards needn't aggregate over every violation series
+type summaryCollector struct {
+	violations *prometheus.Desc
+	objects    *prometheus.Desc
+}
+
+// newSummaryCollector returns a collector for opa_policy_violations_current & opa_objects_evaluated_current
+func newSummaryCollector() *summaryCollector {
+	return &summaryCollector{
+		violations: prometheus.NewDesc(
+			"opa_policy_violations_current",
+			"Current number of policy violations by namespace, kind and ruleset.",
+			[]string{"namespace", "kind", "ruleset"},
+			nil,
+		),
+		objects: prometheus.NewDesc(
+			"opa_objects_evaluated_current",
+			"Current number of evaluated Kubernetes objects by kind.",
+			[]string{"kind"},
+			nil,
+		),
+	}
+}
+
+func (c *summaryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.violations
+	ch <- c.objects
+}
+
+func (c *summaryCollector) Collect(ch chan<- prometheus.Metric) {
+	violations := make(map[[3]string]int)
+	currentViolations.each(func(_ queryConfig, v Violation) {
+		violations[[3]string{v.Namespace, v.Kind, v.RuleSet}]++
+	})
+	for k, n := range violations {
+		ch <- prometheus.MustNewConstMetric(c.violations, prometheus.GaugeValue, float64(n), k[0], k[1], k[2])
+	}
+
+	objects := make(map[string]int)
+	currentViolations.eachObject(func(ref objectRef) {
+		objects[ref.Kind]++
+	})
+	for kind, n := range objects {
+		ch <- prometheus.MustNewConstMetric(c.objects, prometheus.GaugeValue, float64(n), kind)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestEvaluateQueryMetrics(t *testing.T) {
+	initConfig()
+
+	bundles := []bundleConfig{{
+		Name:     "default",
+		Policies: conf.Load().Bundles[0].Policies,
+		Queries: []queryConfig{
+			{Name: "shared", Query: "data[_].main"},
+			{Name: "separate", Query: "data[_].main", Metric: "kove_test_violation"},
+		},
+	}}
+
+	compiled := policies
+	policies = newPolicySet()
+	defer func() { policies = compiled }()
+	_, err := policies.compile(context.Background(), bundles)
+	require.NoError(t, err)
+	require.NoError(t, violationFamilies.register(prometheus.NewRegistry(), bundles))
+
+	separate := violationFamilies.get(bundles[0].Queries[1])
+	require.NotSame(t, violation, separate)
+	defer resetViolations()
+
+	obj := newUnstructured("extensions/v1beta1", "deployment", "test", "test", "1", annotationsTeam, getChartLabels("3.0.0"), false)
+	evaluations := testutil.ToFloat64(totalObjectEvaluations.WithLabelValues("separate"))
+
+	require.NoError(t, evaluate(testGVR, obj))
+	require.Equal(t, 1, testutil.CollectAndCount(violation))
+	require.Equal(t, 1, testutil.CollectAndCount(separate))
+	require.Equal(t, evaluations+1, testutil.ToFloat64(totalObjectEvaluations.WithLabelValues("separate")))
+
+	// Series of queries that no longer apply are removed on the next evaluation
+	bundles[0].Kinds = []string{"Service"}
+	_, err = policies.compile(context.Background(), bundles)
+	require.NoError(t, err)
+	require.NoError(t, evaluate(testGVR, obj))
+	require.Equal(t, 0, testutil.CollectAndCount(violation))
+	require.Equal(t, 0, testutil.CollectAndCount(separate))
+}
+
+func TestSeverityCollector(t *testing.T) {
+	initConfig()
+	resetViolations()
+	defer resetViolations()
+
+	for i, severity := range []string{"", "critical", "critical"} {
+		obj := newUnstructured("apps/v1", "Deployment", "test", fmt.Sprintf("test-%d", i), "1", emptyMap, emptyMap, false)
+		v := objectViolation(obj, "bad", severity)
+		if severity == "" {
+			v.Severity = conf.Load().Severity.Default
+		}
+		currentViolations.record(testGVR, obj, []queryViolations{{query: testQuery, violations: []Violation{v}}}, limitsConfig{})
+	}
+
+	want := `
+# HELP opa_policy_violations_by_severity Current number of policy violations by namespace and severity.
+# TYPE opa_policy_violations_by_severity gauge
+opa_policy_violations_by_severity{namespace="test",severity="critical"} 2
+opa_policy_violations_by_severity{namespace="test",severity="medium"} 1
+`
+	require.NoError(t, testutil.CollectAndCompare(newSeverityCollector(), strings.NewReader(want)))
+
+	// Objects no longer violating are no longer counted
+	obj := newUnstructured("apps/v1", "Deployment", "test", "test-0", "1", emptyMap, emptyMap, false)
+	currentViolations.record(testGVR, obj, []queryViolations{{query: testQuery}}, limitsConfig{})
+	require.Equal(t, 1, testutil.CollectAndCount(newSeverityCollector()))
+}
+
+func TestExtraLabels(t *testing.T) {
+	initConfig()
+	c := *conf.Load()
+	c.Labels.MaxValues = 2
+	conf.Store(&c)
+	defer initConfig()
+
+	violationFamilies.setExtraLabels([]string{"team"})
+	defer violationFamilies.setExtraLabels(nil)
+	labelValues = newLabelGuard()
+
+	for i, team := range []string{"payments", "search", "payments", "billing"} {
+		obj := newUnstructured("apps/v1", "Deployment", "test", fmt.Sprintf("test-%d", i), "1", emptyMap, emptyMap, false)
+		v := objectViolation(obj, "bad", "medium")
+		v.Labels = map[string]string{"team": team, "unexported": "value"}
+		registerViolation(testQuery, v)
+	}
+
+	want := map[string]int{"payments": 2, "search": 1, labelOverflow: 1}
+	for team, n := range want {
+		require.Equal(t, n, violation.DeletePartialMatch(prometheus.Labels{"team": team}), team)
+	}
+	require.Equal(t, 1.0, testutil.ToFloat64(totalLabelOverflows.WithLabelValues("team")))
+}
+
+func TestLabelGuardRelease(t *testing.T) {
+	initConfig()
+	c := *conf.Load()
+	c.Labels.MaxValues = 2
+	conf.Store(&c)
+	defer initConfig()
+
+	violationFamilies.setExtraLabels([]string{"team"})
+	defer violationFamilies.setExtraLabels(nil)
+	labelValues = newLabelGuard()
+	resetViolations()
+	defer resetViolations()
+
+	register := func(name, namespace, team string) *unstructured.Unstructured {
+		obj := newUnstructured("apps/v1", "Deployment", namespace, name, "1", emptyMap, emptyMap, false)
+		v := objectViolation(obj, "bad", "medium")
+		v.Labels = map[string]string{"team": team}
+		registerViolation(testQuery, v)
+		return obj
+	}
+	exported := func(team string) bool {
+		return testutil.ToFloat64(violation.With(prometheus.Labels{
+			"name": "new", "namespace": "other", "kind": "Deployment", "api_version": "apps/v1",
+			"ruleset": "bad", "data": "", "severity": "medium", "query": testQuery.Name, "team": team,
+		})) == 1
+	}
+
+	register("payments", "test", "payments")
+	search := register("search", "test", "search")
+	register("new", "other", "billing")
+	require.True(t, exported(labelOverflow), "limit reached")
+
+	// Deleting an object's series frees the values only it held
+	deleteViolations(objectLabels(search))
+	register("new", "other", "billing")
+	require.True(t, exported("billing"))
+
+	// As does deleting a namespace's series
+	deleteViolations(prometheus.Labels{"namespace": "test"})
+	register("new", "other", "search")
+	require.True(t, exported("search"))
+
+	// And resetting every series
+	resetViolations()
+	register("a", "test", "a")
+	register("b", "test", "b")
+	register("new", "other", "c")
+	require.True(t, exported(labelOverflow))
+}
+
+func TestTruncateData(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := map[string]struct {
+		data string
+		max  int
+		want int
+	}{
+		"short":     {data: "short", max: 256, want: 5},
+		"long":      {data: long, max: 256, want: 256},
+		"unlimited": {data: long, max: 0, want: 300},
+		"multibyte": {data: strings.Repeat("é", 20), max: 20, want: 19},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := truncateData(tc.data, tc.max)
+			require.Len(t, got, tc.want)
+			require.True(t, utf8.ValidString(got))
+		})
+	}
+
+	// Values differing after the cut remain distinct
+	require.NotEqual(t, truncateData(long+"b", 256), truncateData(long+"c", 256))
+}
+
+func TestSummaryCollector(t *testing.T) {
+	initConfig()
+	resetViolations()
+	defer resetViolations()
+
+	for i, ruleset := range []string{"deprecated", "deprecated", ""} {
+		obj := newUnstructured("apps/v1", "Deployment", "test", fmt.Sprintf("test-%d", i), "1", emptyMap, emptyMap, false)
+		qv := queryViolations{query: testQuery}
+		if ruleset != "" {
+			qv.violations = []Violation{objectViolation(obj, ruleset, "medium")}
+		}
+		currentViolations.record(testGVR, obj, []queryViolations{qv}, limitsConfig{})
+	}
+
+	want := `
+# HELP opa_objects_evaluated_current Current number of evaluated Kubernetes objects by kind.
+# TYPE opa_objects_evaluated_current gauge
+opa_objects_evaluated_current{kind="Deployment"} 3
+# HELP opa_policy_violations_current Current number of policy violations by namespace, kind and ruleset.
+# TYPE opa_policy_violations_current gauge
+opa_policy_violations_current{kind="Deployment",namespace="test",ruleset="deprecated"} 2
+`
+	require.NoError(t, testutil.CollectAndCompare(newSummaryCollector(), strings.NewReader(want)))
+
+	// Deleted objects are no longer counted
+	deleteAllMetricsForObject(newUnstructured("apps/v1", "Deployment", "test", "test-0", "1", emptyMap, emptyMap, false))
+	require.Equal(t, 2, testutil.CollectAndCount(newSummaryCollector(), "opa_objects_evaluated_current", "opa_policy_violations_current"))
+}
+
+func TestDisableViolationSeries(t *testing.T) {
+	initConfig()
+	c := *conf.Load()
+	c.DisableViolationSeries = true
+	conf.Store(&c)
+	defer initConfig()
+	resetViolations()
+	defer resetViolations()
+
+	obj := newUnstructured("extensions/v1beta1", "deployment", "test", "test", "1", annotationsTeam, getChartLabels("3.0.0"), false)
+	require.NoError(t, evaluate(testGVR, obj))
+	require.Equal(t, 0, getNumberOfViolations())
+	require.Equal(t, 1, testutil.CollectAndCount(newSummaryCollector(), "opa_policy_violations_current"))
+}
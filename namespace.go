@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	klog "k8s.io/klog/v2"
+)
+
+var (
+	namespacesGVR = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+
+	// Namespaces currently matching the configured namespace selector
+	selectedNamespaces = &namespaceSet{names: make(map[string]struct{})}
+)
+
+// namespaceSet is a set of namespace names, safe for concurrent use
+type namespaceSet struct {
+	mu    sync.RWMutex
+	names map[string]struct{}
+}
+
+func (n *namespaceSet) has(name string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	_, ok := n.names[name]
+	return ok
+}
+
+// set adds or removes a namespace, reporting whether the set changed
+func (n *namespaceSet) set(name string, present bool) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.names[name]
+	if present {
+		n.names[name] = struct{}{}
+	} else {
+		delete(n.names, name)
+	}
+	return ok != present
+}
+
+// watchingNamespace reports whether objects in the given namespace should be evaluated.
+// Cluster scoped objects (with an empty namespace) are only evaluated when we're not
+// restricted to particular namespaces
+func watchingNamespace(c *config, namespace string) bool {
+	if namespace == "" {
+		return !c.namespaced()
+	}
+	if contains(c.ExcludeNamespaces, namespace) {
+		return false
+	}
+	if len(c.Namespaces) > 0 && !contains(c.Namespaces, namespace) {
+		return false
+	}
+	if c.NamespaceSelector != "" && !selectedNamespaces.has(namespace) {
+		return false
+	}
+	return true
+}
+
+// informerNamespaces returns the namespaces to start informers in.
+// Given a list of namespaces, we start informers in each of them, so we only need
+// permission to watch those. Otherwise, informers watch all namespaces and we filter
+func informerNamespaces(c *config) []string {
+	if len(c.Namespaces) == 0 || c.NamespaceSelector != "" {
+		return []string{metav1.NamespaceAll}
+	}
+
+	var namespaces []string
+	for _, ns := range c.Namespaces {
+		if !contains(c.ExcludeNamespaces, ns) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}
+
+// informerName names an informer watching a resource in a namespace, for reporting health
+func informerName(gvr schema.GroupVersionResource, namespace string) string {
+	if namespace == metav1.NamespaceAll {
+		return gvr.String()
+	}
+	return gvr.String() + " in " + namespace
+}
+
+// watchNamespaceSelector starts an informer tracking the namespaces which match our
+// namespace selector. When a namespace starts matching, its objects are evaluated.
+// When it stops matching (or is deleted), its series are removed
+func watchNamespaceSelector(dc dynamic.Interface, stopCh <-chan struct{}) cache.SharedIndexInformer {
+	informer := dynamicinformer.NewFilteredDynamicInformer(dc, namespacesGVR, metav1.NamespaceAll, 0, cache.Indexers{}, nil).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { onNamespaceChange(obj, true) },
+		UpdateFunc: func(_, newObj interface{}) { onNamespaceChange(newObj, true) },
+		DeleteFunc: func(obj interface{}) { onNamespaceChange(obj, false) },
+	})
+	health.addInformer(namespacesGVR.String(), informer)
+
+	go informer.Run(stopCh)
+	return informer
+}
+
+// onNamespaceChange updates our set of selected namespaces
+func onNamespaceChange(obj interface{}, exists bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	ns, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	selected := exists && conf.Load().namespaceSelector.Matches(labels.Set(ns.GetLabels()))
+	if !selectedNamespaces.set(ns.GetName(), selected) {
+		return
+	}
+
+	if selected {
+		klog.InfoS("namespace selected, evaluating its objects", "namespace", ns.GetName())
+		reevaluateNamespace(ns.GetName())
+	} else {
+		klog.InfoS("namespace no longer selected, removing its series", "namespace", ns.GetName())
+		deleteViolations(prometheus.Labels{"namespace": ns.GetName()})
+		currentViolations.deleteNamespace(ns.GetName())
+	}
+}
+
+// reevaluateNamespace queues every cached object in a namespace for evaluation
+func reevaluateNamespace(namespace string) {
+	if !leading.Load() {
+		return
+	}
+
+	for ik, store := range stores {
+		for _, k := range store.ListKeys() {
+			if strings.HasPrefix(k, namespace+"/") {
+				queue.Add(objectKey{GVR: ik.GVR, Namespace: namespace, Name: strings.TrimPrefix(k, namespace+"/")})
+			}
+		}
+	}
+}
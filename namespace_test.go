@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestWatchingNamespace(t *testing.T) {
+	selectedNamespaces.set("selected", true)
+	defer selectedNamespaces.set("selected", false)
+
+	tests := map[string]struct {
+		conf      config
+		namespace string
+		want      bool
+	}{
+		"all namespaces": {
+			conf:      config{},
+			namespace: "test",
+			want:      true,
+		},
+		"cluster scoped, all namespaces": {
+			conf:      config{},
+			namespace: "",
+			want:      true,
+		},
+		"excluded": {
+			conf:      config{ExcludeNamespaces: []string{"test"}},
+			namespace: "test",
+			want:      false,
+		},
+		"listed": {
+			conf:      config{Namespaces: []string{"test", "other"}},
+			namespace: "test",
+			want:      true,
+		},
+		"not listed": {
+			conf:      config{Namespaces: []string{"other"}},
+			namespace: "test",
+			want:      false,
+		},
+		"listed and excluded": {
+			conf:      config{Namespaces: []string{"test"}, ExcludeNamespaces: []string{"test"}},
+			namespace: "test",
+			want:      false,
+		},
+		"cluster scoped, listed namespaces": {
+			conf:      config{Namespaces: []string{"test"}},
+			namespace: "",
+			want:      false,
+		},
+		"selected": {
+			conf:      config{NamespaceSelector: "team=test"},
+			namespace: "selected",
+			want:      true,
+		},
+		"not selected": {
+			conf:      config{NamespaceSelector: "team=test"},
+			namespace: "test",
+			want:      false,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.want, watchingNamespace(&tc.conf, tc.namespace))
+		})
+	}
+}
+
+func TestInformerNamespaces(t *testing.T) {
+	tests := map[string]struct {
+		conf config
+		want []string
+	}{
+		"all namespaces": {
+			conf: config{ExcludeNamespaces: []string{"kube-system"}},
+			want: []string{""},
+		},
+		"listed": {
+			conf: config{Namespaces: []string{"test", "other", "kube-system"}, ExcludeNamespaces: []string{"kube-system"}},
+			want: []string{"test", "other"},
+		},
+		"selector": {
+			conf: config{Namespaces: []string{"test"}, NamespaceSelector: "team=test"},
+			want: []string{""},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.want, informerNamespaces(&tc.conf))
+		})
+	}
+}
+
+func TestOnNamespaceChange(t *testing.T) {
+	initConfig()
+	c := *conf.Load()
+	c.NamespaceSelector = "team=test"
+	c.namespaceSelector = labels.SelectorFromSet(labels.Set{"team": "test"})
+	conf.Store(&c)
+	defer initConfig()
+
+	processQueue()
+	violation.Reset()
+	stores[testKey] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	storeObject(t, newUnstructured("extensions/v1beta1", "deployment", "test", "test", "1", annotationsTeam, getChartLabels("3.0.0"), false))
+
+	ns := &unstructured.Unstructured{}
+	ns.SetAPIVersion("v1")
+	ns.SetKind("Namespace")
+	ns.SetName("test")
+
+	// Namespaces outside of the selector aren't evaluated
+	onNamespaceChange(ns, true)
+	require.Equal(t, 0, queue.Len())
+
+	// Once a namespace matches, its objects are evaluated
+	ns.SetLabels(map[string]string{"team": "test"})
+	onNamespaceChange(ns, true)
+	processQueue()
+	require.Equal(t, 1, getNumberOfViolations())
+
+	// And once it's deleted, its series are removed
+	onNamespaceChange(ns, false)
+	require.Equal(t, 0, getNumberOfViolations())
+	require.False(t, selectedNamespaces.has("test"))
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/loader"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// policyEngine holds a prepared Rego query that is shared by every evaluation.
+// Preparing a query parses and compiles all of the policy files, so this is only
+// done when the policy set changes rather than for every observed object
+type policyEngine struct {
+	mu     sync.RWMutex
+	query  *rego.PreparedEvalQuery
+	digest string
+
+	// The error from the most recent compilation, if it failed
+	err error
+}
+
+// errNoQuery is returned when evaluating before any policies have been compiled
+var errNoQuery = errors.New("no policies have been successfully compiled")
+
+// newPolicyEngine returns an engine with no prepared query
+func newPolicyEngine() *policyEngine {
+	return &policyEngine{}
+}
+
+// preparedQuery is a query prepared by an engine but not yet committed to it
+type preparedQuery struct {
+	query  rego.PreparedEvalQuery
+	digest string
+}
+
+// compile prepares the given query against the policies found at paths, and commits it.
+// If neither the query nor the policy files have changed since the last successful
+// preparation, nothing is done and false is returned.
+// The previously prepared query is only replaced if preparation succeeds
+func (p *policyEngine) compile(ctx context.Context, query string, paths []string) (bool, error) {
+	pq, err := p.prepare(ctx, query, paths)
+	if err != nil || pq == nil {
+		return false, err
+	}
+	p.commit(pq)
+	return true, nil
+}
+
+// prepare prepares the given query against the policies found at paths, leaving the
+// engine's query in place until it's committed. If neither the query nor the policy files
+// have changed since the last successful preparation, nil is returned
+func (p *policyEngine) prepare(ctx context.Context, query string, paths []string) (*preparedQuery, error) {
+	digest, err := policyDigest(query, paths)
+	if err != nil {
+		p.failed(err)
+		return nil, err
+	}
+
+	p.mu.RLock()
+	unchanged := p.query != nil && p.digest == digest
+	p.mu.RUnlock()
+	if unchanged {
+		return nil, nil
+	}
+
+	pq, err := prepareQuery(ctx, query, paths)
+	if err != nil {
+		p.failed(err)
+		return nil, err
+	}
+	return &preparedQuery{query: pq, digest: digest}, nil
+}
+
+// commit replaces the engine's query with one it prepared
+func (p *policyEngine) commit(pq *preparedQuery) {
+	p.mu.Lock()
+	p.query = &pq.query
+	p.digest = pq.digest
+	p.err = nil
+	p.mu.Unlock()
+}
+
+// prepareQuery compiles the policies found at paths and prepares the query against them
+func prepareQuery(ctx context.Context, query string, paths []string) (rego.PreparedEvalQuery, error) {
+	return rego.New(rego.Query(bindWildcards(query)), rego.Load(paths, skipTestFiles)).PrepareForEval(ctx)
+}
+
+// failed records a failure to compile our policies
+func (p *policyEngine) failed(err error) {
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+
+	for _, pkg := range errorPackages(err) {
+		totalCompileErrors.WithLabelValues(pkg).Inc()
+	}
+}
+
+// ready reports whether policies have been compiled and can be evaluated against.
+// If the most recent compilation failed, its error is returned, even though a
+// previously compiled query may still be in use
+func (p *policyEngine) ready() (bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.query != nil, p.err
+}
+
+// eval evaluates the input against the prepared query
+func (p *policyEngine) eval(ctx context.Context, input interface{}) (rego.ResultSet, error) {
+	p.mu.RLock()
+	pq := p.query
+	p.mu.RUnlock()
+
+	if pq == nil {
+		return nil, errNoQuery
+	}
+
+	rs, err := pq.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		for _, pkg := range errorPackages(err) {
+			totalEvalErrors.WithLabelValues(pkg).Inc()
+		}
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+// policySet holds a policy engine for each query of each of our bundles, evaluating
+// objects against the bundles that apply to them
+type policySet struct {
+	mu      sync.RWMutex
+	bundles []*policyBundle
+
+	// The error from the most recent compilation, if any bundle failed
+	err error
+}
+
+// policyBundle is a bundle's config along with its compiled queries, in the
+// order of its config's queries
+type policyBundle struct {
+	bundleConfig
+	engines []*policyEngine
+}
+
+// queryResult holds the result of evaluating a query
+type queryResult struct {
+	query queryConfig
+	rs    rego.ResultSet
+}
+
+// newPolicySet returns a set with no bundles
+func newPolicySet() *policySet {
+	return &policySet{}
+}
+
+// compile prepares each query of each bundle against the bundle's policies. Engines are
+// kept between compilations by bundle & query name, so unchanged queries aren't
+// recompiled. Prepared queries are only committed to their engines, and the new bundles
+// swapped in, once every query of every bundle compiles, so a failed compilation
+// keeps evaluating exactly as before.
+// Returns whether any bundle has changed, and the errors of those that failed
+func (s *policySet) compile(ctx context.Context, bundles []bundleConfig) (bool, error) {
+	s.mu.RLock()
+	existing := make(map[string]*policyBundle)
+	for _, b := range s.bundles {
+		existing[b.Name] = b
+	}
+	changed := len(bundles) != len(s.bundles)
+	s.mu.RUnlock()
+
+	type pending struct {
+		pe *policyEngine
+		pq *preparedQuery
+	}
+	var prepared []pending
+	var next []*policyBundle
+	var errs []error
+	for _, b := range bundles {
+		engines := make(map[string]*policyEngine)
+		if prev, ok := existing[b.Name]; ok {
+			for i, q := range prev.Queries {
+				engines[q.Name] = prev.engines[i]
+			}
+			changed = changed || !reflect.DeepEqual(prev.bundleConfig, b)
+		} else {
+			changed = true
+		}
+
+		pb := &policyBundle{bundleConfig: b}
+		for _, q := range b.Queries {
+			pe, ok := engines[q.Name]
+			if !ok {
+				pe = newPolicyEngine()
+			}
+
+			pq, err := pe.prepare(ctx, q.Query, b.Policies)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("bundle %q query %q: %w", b.Name, q.Name, err))
+			}
+			if pq != nil {
+				prepared = append(prepared, pending{pe: pe, pq: pq})
+				changed = true
+			}
+			pb.engines = append(pb.engines, pe)
+		}
+		next = append(next, pb)
+	}
+	err := errors.Join(errs...)
+
+	s.mu.Lock()
+	if err == nil {
+		for _, p := range prepared {
+			p.pe.commit(p.pq)
+		}
+		s.bundles = next
+	}
+	s.err = err
+	s.mu.Unlock()
+
+	if err != nil {
+		policiesLoaded.Set(0)
+	} else {
+		policiesLoaded.Set(1)
+	}
+	return changed, err
+}
+
+// ready reports whether every query has been compiled and can be evaluated against.
+// If the most recent compilation failed, its error is returned
+func (s *policySet) ready() (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	loaded := len(s.bundles) > 0
+	for _, b := range s.bundles {
+		for _, pe := range b.engines {
+			ready, _ := pe.ready()
+			loaded = loaded && ready
+		}
+	}
+	return loaded, s.err
+}
+
+// eval evaluates the input against the queries of every bundle applying to the given
+// resource & kind, returning the result of each
+func (s *policySet) eval(ctx context.Context, gvr schema.GroupVersionResource, kind string, input interface{}) ([]queryResult, error) {
+	s.mu.RLock()
+	bundles := s.bundles
+	s.mu.RUnlock()
+
+	if len(bundles) == 0 {
+		return nil, errNoQuery
+	}
+
+	var results []queryResult
+	for _, b := range bundles {
+		if !b.appliesTo(gvr, kind) {
+			continue
+		}
+		for i, q := range b.Queries {
+			rs, err := b.engines[i].eval(ctx, input)
+			if err != nil {
+				return nil, fmt.Errorf("bundle %q query %q: %w", b.Name, q.Name, err)
+			}
+			results = append(results, queryResult{query: q, rs: rs})
+		}
+	}
+	return results, nil
+}
+
+// bindWildcards names the wildcards of a query's references to data, so each result binds
+// the package it came from (data[_].main becomes data[kove_pkg0].main) and its output can be
+// attributed to the rule producing it. Queries that don't parse are returned unchanged
+func bindWildcards(query string) string {
+	body, err := ast.ParseBody(query)
+	if err != nil {
+		return query
+	}
+
+	n := 0
+	ast.WalkRefs(body, func(ref ast.Ref) bool {
+		if !ref.HasPrefix(ast.DefaultRootRef) {
+			return false
+		}
+		for _, t := range ref[1:] {
+			if v, ok := t.Value.(ast.Var); ok && v.IsWildcard() {
+				t.Value = ast.Var(fmt.Sprintf("kove_pkg%d", n))
+				n++
+			}
+		}
+		return false
+	})
+	return body.String()
+}
+
+// skipTestFiles is a loader filter skipping kove's policy test specs and their fixtures,
+// so they aren't loaded as data alongside the policies they test
+func skipTestFiles(_ string, info fs.FileInfo, _ int) bool {
+	return info.Name() == testSpecFile || (info.IsDir() && info.Name() == testdataDir)
+}
+
+// errorPackages returns the packages of the policies an error from compiling or
+// evaluating refers to. Where the policy can't be determined, "unknown" is used
+func errorPackages(err error) []string {
+	var pkgs []string
+	seen := make(map[string]bool)
+	for _, loc := range errorLocations(err) {
+		pkg := "unknown"
+		if loc != nil && loc.File != "" {
+			pkg = filePackage(loc.File)
+		}
+		if !seen[pkg] {
+			seen[pkg] = true
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
+
+// errorLocations returns the location of each error held in err.
+// Errors without a location are represented by nil
+func errorLocations(err error) []*ast.Location {
+	switch e := err.(type) {
+	case ast.Errors:
+		var locs []*ast.Location
+		for _, ae := range e {
+			locs = append(locs, ae.Location)
+		}
+		return locs
+	case *ast.Error:
+		return []*ast.Location{e.Location}
+	case *topdown.Error:
+		return []*ast.Location{e.Location}
+	case loader.Errors:
+		var locs []*ast.Location
+		for _, le := range e {
+			locs = append(locs, errorLocations(le)...)
+		}
+		return locs
+	}
+
+	if u := errors.Unwrap(err); u != nil {
+		return errorLocations(u)
+	}
+	return []*ast.Location{nil}
+}
+
+// filePackage returns the package declared by a policy file, without requiring
+// the file to be valid Rego. If no package is found, the file name is returned
+func filePackage(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return file
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "package" {
+			return fields[1]
+		}
+	}
+	return file
+}
+
+// policyDigest returns a hash of the query and the contents of every file found
+// at paths, so we can tell when a policy set has changed
+func policyDigest(query string, paths []string) (string, error) {
+	var files []string
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// Walking doesn't follow symlinks (as used by ConfigMap mounts),
+			// so resolve what each entry points at
+			info, err := os.Stat(p)
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	io.WriteString(h, query)
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, file)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const testPolicy = `package test
+
+main[output] {
+	input.bad
+	output := {"Name": "test", "Namespace": "test", "Kind": "Test", "ApiVersion": "v1", "RuleSet": "%s"}
+}
+`
+
+func TestPolicyEngineCompile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	query := "data[_].main"
+
+	require.NoError(t, os.WriteFile(policy, []byte(testPolicy), 0o644))
+
+	p := newPolicyEngine()
+	_, err := p.eval(ctx, map[string]interface{}{"bad": true})
+	require.Error(t, err, "evaluating without a prepared query")
+
+	ready, _ := p.ready()
+	require.False(t, ready)
+
+	changed, err := p.compile(ctx, query, []string{dir})
+	require.NoError(t, err)
+	require.True(t, changed, "initial compile")
+
+	changed, err = p.compile(ctx, query, []string{dir})
+	require.NoError(t, err)
+	require.False(t, changed, "unchanged policies")
+
+	require.NoError(t, os.WriteFile(policy, []byte(testPolicy+"\n# changed\n"), 0o644))
+	changed, err = p.compile(ctx, query, []string{dir})
+	require.NoError(t, err)
+	require.True(t, changed, "changed policies")
+
+	// A broken policy should leave the previous query in place
+	require.NoError(t, os.WriteFile(policy, []byte("package test\nmain[output] {"), 0o644))
+	_, err = p.compile(ctx, query, []string{dir})
+	require.Error(t, err)
+	require.Equal(t, []string{"test"}, errorPackages(err))
+
+	ready, err = p.ready()
+	require.True(t, ready, "previous query still in use")
+	require.Error(t, err)
+
+	rs, err := p.eval(ctx, map[string]interface{}{"bad": true})
+	require.NoError(t, err)
+	require.Len(t, rs, 1)
+}
+
+func TestPolicyEngineEvalErrorPackage(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	policy := "package conflicting\n\nmain = 1 {\n\tinput.a\n}\n\nmain = 2 {\n\tinput.b\n}\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "policy.rego"), []byte(policy), 0o644))
+
+	p := newPolicyEngine()
+	_, err := p.compile(ctx, "data[_].main", []string{dir})
+	require.NoError(t, err)
+
+	_, err = p.eval(ctx, map[string]interface{}{"a": true, "b": true})
+	require.Error(t, err)
+	require.Equal(t, []string{"conflicting"}, errorPackages(err))
+}
+
+func TestBindWildcards(t *testing.T) {
+	tests := map[string]string{
+		"data[_].main":                    "data[kove_pkg0].main",
+		"data[_][_]":                      "data[kove_pkg0][kove_pkg1]",
+		"data.test.main":                  "data.test.main",
+		"x := data[_].deny; count(x) > 0": "assign(x, data[kove_pkg0].deny); gt(count(x), 0)",
+		"data[pkg].main":                  "data[pkg].main",
+		"not valid rego (":                "not valid rego (",
+	}
+
+	for query, want := range tests {
+		t.Run(query, func(t *testing.T) {
+			require.Equal(t, want, bindWildcards(query))
+		})
+	}
+}
+
+func TestPolicySetEval(t *testing.T) {
+	ctx := context.Background()
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	services := schema.GroupVersionResource{Version: "v1", Resource: "services"}
+
+	dirs := make(map[string]string)
+	for _, ruleset := range []string{"all", "kinds", "objects"} {
+		dirs[ruleset] = t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dirs[ruleset], "policy.rego"), []byte(fmt.Sprintf(testPolicy, ruleset)), 0o644))
+	}
+
+	s := newPolicySet()
+	_, err := s.eval(ctx, deployments, "Deployment", map[string]interface{}{"bad": true})
+	require.ErrorIs(t, err, errNoQuery)
+
+	changed, err := s.compile(ctx, []bundleConfig{
+		{Name: "all", Policies: []string{dirs["all"]}, Queries: []queryConfig{{Name: "all", Query: "data[_].main"}}},
+		{Name: "kinds", Policies: []string{dirs["kinds"]}, Queries: []queryConfig{{Name: "kinds", Query: "data[_].main"}}, Kinds: []string{"deployment"}},
+		{Name: "objects", Policies: []string{dirs["objects"]}, Queries: []queryConfig{{Name: "objects", Query: "data[_].main"}}, Objects: []schema.GroupVersionResource{services}},
+	})
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	tests := map[string]struct {
+		gvr  schema.GroupVersionResource
+		kind string
+		want []string
+	}{
+		"matching kind": {
+			gvr:  deployments,
+			kind: "Deployment",
+			want: []string{"all", "kinds"},
+		},
+		"matching object": {
+			gvr:  services,
+			kind: "Service",
+			want: []string{"all", "objects"},
+		},
+		"unbound": {
+			gvr:  schema.GroupVersionResource{Version: "v1", Resource: "configmaps"},
+			kind: "ConfigMap",
+			want: []string{"all"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rs, err := s.eval(ctx, tc.gvr, tc.kind, map[string]interface{}{"bad": true})
+			require.NoError(t, err)
+
+			var got []string
+			for _, r := range rs {
+				for _, e := range r.rs[0].Expressions {
+					for _, v := range e.Value.([]interface{}) {
+						got = append(got, v.(map[string]interface{})["RuleSet"].(string))
+					}
+				}
+			}
+			require.ElementsMatch(t, tc.want, got)
+		})
+	}
+
+	// Recompiling the same bundles changes nothing
+	changed, err = s.compile(ctx, []bundleConfig{
+		{Name: "all", Policies: []string{dirs["all"]}, Queries: []queryConfig{{Name: "all", Query: "data[_].main"}}},
+		{Name: "kinds", Policies: []string{dirs["kinds"]}, Queries: []queryConfig{{Name: "kinds", Query: "data[_].main"}}, Kinds: []string{"deployment"}},
+		{Name: "objects", Policies: []string{dirs["objects"]}, Queries: []queryConfig{{Name: "objects", Query: "data[_].main"}}, Objects: []schema.GroupVersionResource{services}},
+	})
+	require.NoError(t, err)
+	require.False(t, changed)
+}
+
+func TestPolicySetCompileFailure(t *testing.T) {
+	ctx := context.Background()
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+	good, bad := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(good, "policy.rego"), []byte(fmt.Sprintf(testPolicy, "good")), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(bad, "policy.rego"), []byte("package bad\nmain[output] {"), 0o644))
+
+	goodBundle := bundleConfig{Name: "good", Policies: []string{good}, Queries: []queryConfig{{Name: "good", Query: "data[_].main"}}}
+	badBundle := bundleConfig{Name: "bad", Policies: []string{bad}, Queries: []queryConfig{{Name: "bad", Query: "data[_].main"}}}
+
+	s := newPolicySet()
+	_, err := s.compile(ctx, []bundleConfig{goodBundle})
+	require.NoError(t, err)
+
+	// Reloading with a new, broken bundle keeps the previous bundles
+	_, err = s.compile(ctx, []bundleConfig{goodBundle, badBundle})
+	require.Error(t, err)
+
+	ready, err := s.ready()
+	require.True(t, ready, "previous bundles still in use")
+	require.Error(t, err)
+
+	rs, err := s.eval(ctx, deployments, "Deployment", map[string]interface{}{"bad": true})
+	require.NoError(t, err)
+	require.Len(t, rs, 1)
+	require.Equal(t, "good", rs[0].query.Name)
+
+	// Changes to existing bundles aren't applied while another bundle, or another
+	// query of the same bundle, fails to compile
+	require.NoError(t, os.WriteFile(filepath.Join(good, "policy.rego"), []byte(fmt.Sprintf(testPolicy, "changed")), 0o644))
+	brokenQuery := goodBundle
+	brokenQuery.Queries = append([]queryConfig{}, goodBundle.Queries...)
+	brokenQuery.Queries = append(brokenQuery.Queries, queryConfig{Name: "broken", Query: "data[_].main["})
+
+	for name, bundles := range map[string][]bundleConfig{
+		"failing bundle": {goodBundle, badBundle},
+		"failing query":  {brokenQuery},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := s.compile(ctx, bundles)
+			require.Error(t, err)
+
+			rs, err := s.eval(ctx, deployments, "Deployment", map[string]interface{}{"bad": true})
+			require.NoError(t, err)
+			require.Len(t, rs, 1)
+			require.Equal(t, "good", firstRuleSet(rs))
+		})
+	}
+
+	// Once every bundle compiles, the changes are applied
+	changed, err := s.compile(ctx, []bundleConfig{goodBundle})
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	rs, err = s.eval(ctx, deployments, "Deployment", map[string]interface{}{"bad": true})
+	require.NoError(t, err)
+	require.Equal(t, "changed", firstRuleSet(rs))
+}
+
+// firstRuleSet returns the ruleset of the first violation found by the first query
+func firstRuleSet(rs []queryResult) interface{} {
+	return rs[0].rs[0].Expressions[0].Value.([]interface{})[0].(map[string]interface{})["RuleSet"]
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/open-policy-agent/opa/tester"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Names of kove's policy test specs, and of the directories holding their fixtures
+const (
+	testSpecFile = "kove_test.yaml"
+	testdataDir  = "testdata"
+)
+
+// testSpec outlines test cases for the policies in a directory
+type testSpec struct {
+	Tests []testCase `json:"tests"`
+}
+
+// testCase outlines manifests to evaluate, relative to the spec, and the violations
+// expected to be found in them
+type testCase struct {
+	Name       string              `json:"name"`
+	Manifests  []string            `json:"manifests"`
+	Violations []expectedViolation `json:"violations"`
+}
+
+// expectedViolation is a violation a test case expects to be found.
+// Its query and severity are only compared when given
+type expectedViolation struct {
+	Query      string `json:"Query,omitempty"`
+	Name       string `json:"Name"`
+	Namespace  string `json:"Namespace"`
+	Kind       string `json:"Kind"`
+	ApiVersion string `json:"ApiVersion"`
+	RuleSet    string `json:"RuleSet"`
+	Data       string `json:"Data"`
+	Severity   string `json:"Severity,omitempty"`
+}
+
+// matches reports whether a violation found by the given query is the one expected
+func (e expectedViolation) matches(query string, v Violation) bool {
+	return (e.Query == "" || e.Query == query) &&
+		(e.Severity == "" || e.Severity == v.Severity) &&
+		e.Name == v.Name &&
+		e.Namespace == v.Namespace &&
+		e.Kind == v.Kind &&
+		e.ApiVersion == v.ApiVersion &&
+		e.RuleSet == v.RuleSet &&
+		e.Data == v.Data
+}
+
+func (e expectedViolation) String() string {
+	s := fmt.Sprintf("%s %s (%s) RuleSet=%q Data=%q", e.Kind, objectName(e.Namespace, e.Name), e.ApiVersion, e.RuleSet, e.Data)
+	if e.Severity != "" {
+		s += fmt.Sprintf(" Severity=%q", e.Severity)
+	}
+	if e.Query != "" {
+		s += fmt.Sprintf(" Query=%q", e.Query)
+	}
+	return s
+}
+
+// testResult is the outcome of a test case, or of a native Rego test
+type testResult struct {
+	dir     string
+	name    string
+	skipped bool
+
+	// Why the test failed, if it did
+	failures []string
+}
+
+// testCommand runs the test specs and native Rego tests of every configured policy
+// directory, exiting with exitViolations if any fail
+func testCommand(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	path := fs.String("config", "", "Path to the configuration")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kove test [options]\n\nRuns the %s specs and _test.rego files of every configured policy directory.\n\n", testSpecFile)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+
+	configPath = path
+	c, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to load config: %v\n", err)
+		return exitError
+	}
+	conf.Store(c)
+
+	results, err := runPolicyTests(context.Background(), c.Bundles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if failed := printTestResults(os.Stdout, results); failed > 0 {
+		return exitViolations
+	}
+	return exitOK
+}
+
+// runPolicyTests runs the tests of each policy directory of each bundle
+func runPolicyTests(ctx context.Context, bundles []bundleConfig) ([]testResult, error) {
+	var results []testResult
+	for _, b := range bundles {
+		for _, dir := range b.Policies {
+			info, err := os.Stat(dir)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				continue
+			}
+
+			r, err := runTestSpec(ctx, b, dir)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, r...)
+
+			r, err = runRegoTests(ctx, dir)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, r...)
+		}
+	}
+	return results, nil
+}
+
+// runTestSpec runs the test cases of a policy directory's spec, if it has one.
+// Only the directory's policies are evaluated, through the queries of its bundle
+func runTestSpec(ctx context.Context, b bundleConfig, dir string) ([]testResult, error) {
+	path := filepath.Join(dir, testSpecFile)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var spec testSpec
+	if err := yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(&spec); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	set := newPolicySet()
+	b.Policies = []string{dir}
+	if _, err := set.compile(ctx, []bundleConfig{b}); err != nil {
+		return nil, fmt.Errorf("unable to prepare query from policy data: %w", err)
+	}
+
+	var results []testResult
+	for _, tc := range spec.Tests {
+		result := testResult{dir: dir, name: tc.Name}
+
+		var paths []string
+		for _, m := range tc.Manifests {
+			paths = append(paths, filepath.Join(dir, m))
+		}
+		manifests, err := readManifests(paths, nil)
+		if err != nil {
+			result.failures = []string{err.Error()}
+			results = append(results, result)
+			continue
+		}
+
+		evaluations, err := evalManifests(ctx, set, manifests)
+		if err != nil {
+			result.failures = []string{err.Error()}
+		} else {
+			result.failures = diffViolations(tc.Violations, evaluations)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// diffViolations compares the violations found in manifests with those expected,
+// describing any which are missing or unexpected
+func diffViolations(expected []expectedViolation, evaluations []evaluation) []string {
+	var diff []string
+	matched := make([]bool, len(expected))
+	for _, e := range evaluations {
+		for _, qv := range e.found {
+			for _, v := range qv.violations {
+				found := false
+				for i, want := range expected {
+					if !matched[i] && want.matches(qv.query.Name, v) {
+						matched[i] = true
+						found = true
+						break
+					}
+				}
+				if !found {
+					got := expectedViolation{Query: qv.query.Name, Name: v.Name, Namespace: v.Namespace, Kind: v.Kind, ApiVersion: v.ApiVersion, RuleSet: v.RuleSet, Data: v.Data, Severity: v.Severity}
+					diff = append(diff, "unexpected violation: "+got.String())
+				}
+			}
+		}
+	}
+	for i, want := range expected {
+		if !matched[i] {
+			diff = append(diff, "missing violation: "+want.String())
+		}
+	}
+	return diff
+}
+
+// runRegoTests runs the native Rego tests of a policy directory with OPA's tester
+func runRegoTests(ctx context.Context, dir string) ([]testResult, error) {
+	// tester.RunWithFilter doesn't apply its filter, so we load the policies ourselves
+	modules, store, err := tester.Load([]string{dir}, skipTestFiles)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load Rego tests in %s: %w", dir, err)
+	}
+	ch, err := tester.NewRunner().SetStore(store).Run(ctx, modules)
+	if err != nil {
+		return nil, fmt.Errorf("unable to run Rego tests in %s: %w", dir, err)
+	}
+
+	var results []testResult
+	for r := range ch {
+		result := testResult{dir: dir, name: r.Package + "." + r.Name, skipped: r.Skip}
+		switch {
+		case r.Error != nil:
+			result.failures = []string{r.Error.Error()}
+		case r.Fail:
+			result.failures = []string{"test failed"}
+			if r.FailedAt != nil {
+				result.failures = []string{fmt.Sprintf("failed at %s: %s", r.FailedAt.Location, r.FailedAt)}
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// printTestResults prints the outcome of each test, returning the number that failed
+func printTestResults(w io.Writer, results []testResult) int {
+	passed, failed, skipped := 0, 0, 0
+	for _, r := range results {
+		switch {
+		case len(r.failures) > 0:
+			failed++
+			fmt.Fprintf(w, "FAIL  %s: %s\n", r.dir, r.name)
+			for _, f := range r.failures {
+				fmt.Fprintf(w, "        %s\n", f)
+			}
+		case r.skipped:
+			skipped++
+			fmt.Fprintf(w, "SKIP  %s: %s\n", r.dir, r.name)
+		default:
+			passed++
+			fmt.Fprintf(w, "PASS  %s: %s\n", r.dir, r.name)
+		}
+	}
+	fmt.Fprintf(w, "%d passed, %d failed, %d skipped\n", passed, failed, skipped)
+	return failed
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffViolations(t *testing.T) {
+	obj := newUnstructured("apps/v1", "Deployment", "test", "test", "1", emptyMap, emptyMap, false)
+	found := objectViolation(obj, "bad", "high")
+	evaluations := []evaluation{{found: []queryViolations{{query: testQuery, violations: []Violation{found}}}}}
+	want := expectedViolation{Name: "test", Namespace: "test", Kind: "Deployment", ApiVersion: "apps/v1", RuleSet: "bad"}
+
+	tests := map[string]struct {
+		expected []expectedViolation
+		want     int
+	}{
+		"match":              {expected: []expectedViolation{want}},
+		"match severity":     {expected: []expectedViolation{{Name: "test", Namespace: "test", Kind: "Deployment", ApiVersion: "apps/v1", RuleSet: "bad", Severity: "high", Query: "default"}}},
+		"different severity": {expected: []expectedViolation{{Name: "test", Namespace: "test", Kind: "Deployment", ApiVersion: "apps/v1", RuleSet: "bad", Severity: "low"}}, want: 2},
+		"missing":            {expected: []expectedViolation{want, want}, want: 1},
+		"unexpected":         {want: 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Len(t, diffViolations(tc.expected, evaluations), tc.want)
+		})
+	}
+}
+
+func TestRunPolicyTests(t *testing.T) {
+	initConfig()
+
+	// The example policies' tests pass
+	results, err := runPolicyTests(context.Background(), conf.Load().Bundles)
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+	var out bytes.Buffer
+	require.Equal(t, 0, printTestResults(&out, results))
+
+	// A spec expecting the wrong violations fails
+	dir := t.TempDir()
+	policy, err := os.ReadFile("example/policies/app-chart-version.rego")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app-chart-version.rego"), policy, 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, testdataDir), 0o755))
+	manifest, err := os.ReadFile("example/policies/testdata/old-chart.yaml")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, testdataDir, "old-chart.yaml"), manifest, 0o644))
+	spec := "tests:\n  - name: no violations\n    manifests:\n      - testdata/old-chart.yaml\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, testSpecFile), []byte(spec), 0o644))
+
+	results, err = runPolicyTests(context.Background(), []bundleConfig{{Name: "test", Policies: []string{dir}, Queries: []queryConfig{testQuery}}})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Len(t, results[0].failures, 1)
+	require.Contains(t, results[0].failures[0], "unexpected violation")
+	require.Equal(t, 1, printTestResults(&out, results))
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	klog "k8s.io/klog/v2"
+)
+
+// maxRetries is the number of times an object will be retried before it is dropped
+// from the queue. Retries back off exponentially
+const maxRetries = 5
+
+// objectKey identifies an object to be evaluated.
+// Keys are comparable, so the queue will only hold one pending evaluation per object
+type objectKey struct {
+	GVR       schema.GroupVersionResource
+	Namespace string
+	Name      string
+}
+
+// String returns the key in the namespace/name form used by informer stores
+func (k objectKey) String() string {
+	if k.Namespace == "" {
+		return k.Name
+	}
+	return k.Namespace + "/" + k.Name
+}
+
+// informerKey identifies an informer by the resource it watches and the namespace
+// it watches it in, which is empty for informers watching all namespaces
+type informerKey struct {
+	GVR       schema.GroupVersionResource
+	Namespace string
+}
+
+var (
+	// Stores of every informer we start, by resource and namespace.
+	// Workers read the latest state of an object from here
+	stores = make(map[informerKey]cache.Store)
+
+	queueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workqueue_depth",
+			Help: "Current depth of the workqueue.",
+		},
+		[]string{"name"},
+	)
+
+	queueAdds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workqueue_adds_total",
+			Help: "Total number of adds handled by the workqueue.",
+		},
+		[]string{"name"},
+	)
+
+	queueLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "workqueue_queue_duration_seconds",
+			Help:    "How long in seconds an item stays in the workqueue before being requested.",
+			Buckets: prometheus.ExponentialBuckets(10e-9, 10, 10),
+		},
+		[]string{"name"},
+	)
+
+	queueWorkDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "workqueue_work_duration_seconds",
+			Help:    "How long in seconds processing an item from the workqueue takes.",
+			Buckets: prometheus.ExponentialBuckets(10e-9, 10, 10),
+		},
+		[]string{"name"},
+	)
+
+	queueUnfinishedWork = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workqueue_unfinished_work_seconds",
+			Help: "How many seconds of work has been done that is in progress and hasn't been observed by work_duration.",
+		},
+		[]string{"name"},
+	)
+
+	queueLongestRunningProcessor = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "workqueue_longest_running_processor_seconds",
+			Help: "How many seconds has the longest running processor for the workqueue been running.",
+		},
+		[]string{"name"},
+	)
+
+	queueRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workqueue_retries_total",
+			Help: "Total number of retries handled by the workqueue.",
+		},
+		[]string{"name"},
+	)
+
+	// Number of objects currently being evaluated by our workers
+	inFlight atomic.Int64
+
+	// Queue of objects awaiting evaluation, drained by our workers.
+	// Declared after the metrics above, as creating it requests them from our provider
+	queue = newQueue()
+)
+
+// newQueue returns a rate limited queue which exposes Prometheus metrics
+func newQueue() workqueue.RateLimitingInterface {
+	workqueue.SetProvider(queueMetricsProvider{})
+	return workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "kove")
+}
+
+// enqueue adds an object watched through the given resource to the queue.
+// Followers don't evaluate anything, so nothing is queued until we lead,
+// and objects belonging to other shards or unwatched namespaces are never queued
+func enqueue(gvr schema.GroupVersionResource, obj *unstructured.Unstructured) {
+	c := conf.Load()
+	if !leading.Load() || !ownsObject(c.Sharding, obj) || !watchingNamespace(c, obj.GetNamespace()) {
+		return
+	}
+	queue.Add(objectKey{GVR: gvr, Namespace: obj.GetNamespace(), Name: obj.GetName()})
+}
+
+// runWorker processes items from the queue until it is shut down
+func runWorker() {
+	for processNextItem() {
+	}
+}
+
+// processNextItem evaluates the next object from the queue, requeueing it
+// with a backoff if evaluation fails.
+// Returns false when the queue has been shut down
+func processNextItem() bool {
+	item, shutdown := queue.Get()
+	if shutdown {
+		return false
+	}
+	inFlight.Add(1)
+	defer inFlight.Add(-1)
+	defer queue.Done(item)
+
+	// Once we're shutting down, there's no value in evaluating anything
+	// that hasn't already been started
+	if queue.ShuttingDown() {
+		return true
+	}
+
+	// We may have lost leadership since the object was queued
+	if !leading.Load() {
+		queue.Forget(item)
+		return true
+	}
+
+	key := item.(objectKey)
+	err := syncObject(key)
+	switch {
+	case err == nil:
+		queue.Forget(item)
+	case queue.NumRequeues(item) < maxRetries:
+		klog.ErrorS(err, "unable to evaluate, retrying", "resource", key.GVR.String(), "object", key.String())
+		queue.AddRateLimited(item)
+	default:
+		klog.ErrorS(err, "unable to evaluate, dropping object from the queue", "resource", key.GVR.String(), "object", key.String())
+		queue.Forget(item)
+	}
+
+	return true
+}
+
+// syncObject evaluates the latest state of the object identified by key,
+// replacing any series previously exposed for it
+func syncObject(key objectKey) error {
+	store, ok := stores[informerKey{GVR: key.GVR, Namespace: key.Namespace}]
+	if !ok {
+		store, ok = stores[informerKey{GVR: key.GVR}]
+	}
+	if !ok {
+		return nil
+	}
+
+	obj, exists, err := store.GetByKey(key.String())
+	if err != nil {
+		return err
+	}
+
+	// The object has been deleted. Deletes are queued like any other change,
+	// so no evaluation of the object can be in progress to reinstate its series
+	if !exists {
+		deleteMetricsForKey(key)
+		return nil
+	}
+
+	r := obj.(*unstructured.Unstructured)
+	c := conf.Load()
+	if !ownsObject(c.Sharding, r) || !watchingNamespace(c, r.GetNamespace()) || (c.IgnoreChildren && hasOwnerRefs(r)) {
+		deleteAllMetricsForObject(r)
+		return nil
+	}
+
+	klog.InfoS("evaluating object", strings.ToLower(r.GetKind()), klog.KObj(r))
+	return evaluate(key.GVR, r)
+}
+
+// queueMetricsProvider exposes workqueue metrics through Prometheus
+type queueMetricsProvider struct{}
+
+func (queueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return queueDepth.WithLabelValues(name)
+}
+
+func (queueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return queueAdds.WithLabelValues(name)
+}
+
+func (queueMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return queueLatency.WithLabelValues(name)
+}
+
+func (queueMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return queueWorkDuration.WithLabelValues(name)
+}
+
+func (queueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return queueUnfinishedWork.WithLabelValues(name)
+}
+
+func (queueMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return queueLongestRunningProcessor.WithLabelValues(name)
+}
+
+func (queueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return queueRetries.WithLabelValues(name)
+}
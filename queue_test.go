@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestEnqueueDeduplicates(t *testing.T) {
+	initConfig()
+
+	obj := newUnstructured("extensions/v1beta1", "deployment", "test", "test", "1", annotationsTeam, getChartLabels("3.0.0"), false)
+	storeObject(t, obj)
+
+	enqueue(testGVR, obj)
+	enqueue(testGVR, obj)
+	require.Equal(t, 1, queue.Len())
+
+	processQueue()
+	got := getNumberOfViolations()
+	violation.Reset()
+
+	require.Equal(t, 1, got)
+}
+
+func TestSyncObjectDeleted(t *testing.T) {
+	initConfig()
+
+	obj := newUnstructured("extensions/v1beta1", "deployment", "test", "deleted", "1", annotationsTeam, getChartLabels("3.0.0"), false)
+	err := syncObject(objectKey{GVR: testGVR, Namespace: obj.GetNamespace(), Name: obj.GetName()})
+	require.NoError(t, err)
+	require.Equal(t, 0, getNumberOfViolations())
+}
+
+func TestDeleteQueued(t *testing.T) {
+	initConfig()
+
+	tests := map[string]func(obj *unstructured.Unstructured) interface{}{
+		"object": func(obj *unstructured.Unstructured) interface{} {
+			return obj
+		},
+		"tombstone": func(obj *unstructured.Unstructured) interface{} {
+			return cache.DeletedFinalStateUnknown{Key: obj.GetNamespace() + "/" + obj.GetName(), Obj: obj}
+		},
+	}
+
+	for name, deleted := range tests {
+		t.Run(name, func(t *testing.T) {
+			obj := newUnstructured("extensions/v1beta1", "deployment", "test", "deleted", "1", annotationsTeam, getChartLabels("3.0.0"), false)
+			storeObject(t, obj)
+			enqueue(testGVR, obj)
+			processQueue()
+			require.Equal(t, 1, getNumberOfViolations())
+
+			// Deletes are queued, and the object's series removed by key once
+			// it's gone from the store
+			require.NoError(t, stores[testKey].Delete(obj))
+			onDelete(testGVR, deleted(obj))
+			require.Equal(t, 1, queue.Len())
+			processQueue()
+
+			require.Equal(t, 0, getNumberOfViolations())
+			require.Nil(t, currentViolations.found(obj))
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serverOptions configures the web server for our metrics & health endpoints
+type serverOptions struct {
+	Address string
+
+	// Serve over TLS with this certificate & key, which are reloaded when they change
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Require clients of /metrics to present a certificate signed by this CA,
+	// or the bearer token held in this file
+	ClientCAFile  string
+	AuthTokenFile string
+}
+
+// newServer returns a web server for our metrics & health endpoints.
+// Health endpoints are never authenticated, so they can be used by probes
+func newServer(opts serverOptions) (*http.Server, error) {
+	metrics, err := metricsAuth(opts, promhttp.Handler())
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	mux.HandleFunc("/livez", livez)
+	mux.Handle("/metrics", metrics)
+
+	srv := &http.Server{
+		Addr:              opts.Address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if opts.TLSCertFile == "" && opts.TLSKeyFile == "" {
+		if opts.ClientCAFile != "" {
+			return nil, fmt.Errorf("client certificate authentication requires a TLS certificate and key")
+		}
+		return srv, nil
+	}
+	if opts.TLSCertFile == "" || opts.TLSKeyFile == "" {
+		return nil, fmt.Errorf("both a TLS certificate and key are required")
+	}
+
+	certs := &certReloader{certFile: opts.TLSCertFile, keyFile: opts.TLSKeyFile}
+	if _, err := certs.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	srv.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}
+
+	if opts.ClientCAFile != "" {
+		pem, err := os.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA %s", opts.ClientCAFile)
+		}
+
+		// Certificates are verified if given, but only required by /metrics
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return srv, nil
+}
+
+// serve runs the server until it is shut down, over TLS if configured
+func serve(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
+// metricsAuth wraps the metrics handler with any configured authentication.
+// When both a token and client CA are configured, either is accepted
+func metricsAuth(opts serverOptions, next http.Handler) (http.Handler, error) {
+	if opts.AuthTokenFile == "" && opts.ClientCAFile == "" {
+		return next, nil
+	}
+
+	var token []byte
+	if opts.AuthTokenFile != "" {
+		b, err := os.ReadFile(opts.AuthTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read auth token: %w", err)
+		}
+		token = []byte(strings.TrimSpace(string(b)))
+		if len(token) == 0 {
+			return nil, fmt.Errorf("auth token file %s is empty", opts.AuthTokenFile)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opts.ClientCAFile != "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if token != nil {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if ok && subtle.ConstantTimeCompare([]byte(given), token) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}), nil
+}
+
+// certReloader serves a TLS certificate, reloading it when the files change on disk
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// getCertificate returns the current certificate, reloading it first if the
+// files have been modified. If reloading fails, the previous certificate is kept
+func (c *certReloader) getCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil && c.cert == nil {
+		return nil, err
+	}
+	if err != nil || !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert == nil {
+			return nil, fmt.Errorf("unable to load TLS certificate: %w", err)
+		}
+		return c.cert, nil
+	}
+	c.cert = &cert
+	c.modTime = modTime
+
+	return c.cert, nil
+}
+
+// latestModTime returns the most recent modification time of the given files
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
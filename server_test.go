@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsAuth(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret\n"), 0o600))
+
+	srv, err := newServer(serverOptions{Address: ":0", AuthTokenFile: tokenFile})
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		path  string
+		token string
+		want  int
+	}{
+		"metrics without token":    {path: "/metrics", want: http.StatusUnauthorized},
+		"metrics with wrong token": {path: "/metrics", token: "wrong", want: http.StatusUnauthorized},
+		"metrics with token":       {path: "/metrics", token: "secret", want: http.StatusOK},
+		"health without token":     {path: "/healthz", want: http.StatusOK},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rec, req)
+			require.Equal(t, tc.want, rec.Code)
+		})
+	}
+}
+
+func TestNewServerOptions(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertificate(t, certFile, keyFile, "first")
+
+	tests := map[string]struct {
+		opts    serverOptions
+		wantTLS bool
+		wantErr bool
+	}{
+		"plain":                 {opts: serverOptions{Address: ":0"}},
+		"tls":                   {opts: serverOptions{Address: ":0", TLSCertFile: certFile, TLSKeyFile: keyFile}, wantTLS: true},
+		"cert without key":      {opts: serverOptions{Address: ":0", TLSCertFile: certFile}, wantErr: true},
+		"client CA without tls": {opts: serverOptions{Address: ":0", ClientCAFile: certFile}, wantErr: true},
+		"missing token file":    {opts: serverOptions{Address: ":0", AuthTokenFile: filepath.Join(dir, "missing")}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv, err := newServer(tc.opts)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.wantTLS, srv.TLSConfig != nil)
+		})
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertificate(t, certFile, keyFile, "first")
+
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	cert, err := c.getCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, "first", leafCommonName(t, cert.Certificate[0]))
+
+	// Ensure the modification time moves on, regardless of filesystem precision
+	writeCertificate(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+
+	cert, err = c.getCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, "second", leafCommonName(t, cert.Certificate[0]))
+
+	// A broken certificate should leave the previous one in place
+	require.NoError(t, os.WriteFile(certFile, []byte("broken"), 0o600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+
+	cert, err = c.getCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, "second", leafCommonName(t, cert.Certificate[0]))
+}
+
+// writeCertificate writes a self-signed certificate & key with the given common name
+func writeCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+}
+
+func leafCommonName(t *testing.T, der []byte) string {
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert.Subject.CommonName
+}
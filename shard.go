@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Ways objects can be assigned to shards
+const (
+	shardByNamespace = "namespace"
+	shardByUID       = "uid"
+)
+
+var shardInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "kove_shard_info",
+		Help: "The shard this replica evaluates, and the total number of shards.",
+	},
+	[]string{"index", "shards"},
+)
+
+// ownsObject reports whether an object belongs to the shard we evaluate.
+// Objects are assigned to shards by a consistent hash of their namespace or UID.
+// When sharding by namespace, cluster scoped objects are assigned by their name
+func ownsObject(s shardingConfig, obj *unstructured.Unstructured) bool {
+	if s.Shards <= 1 {
+		return true
+	}
+
+	key := obj.GetNamespace()
+	if s.Key == shardByUID {
+		key = string(obj.GetUID())
+	} else if key == "" {
+		key = obj.GetName()
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return jumpHash(h.Sum64(), s.Shards) == *s.Index
+}
+
+// jumpHash assigns a key to one of the given number of buckets, moving as few
+// keys as possible when the number of buckets changes.
+// See https://arxiv.org/abs/1406.2294
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// statefulSetOrdinal returns the ordinal of our pod within its StatefulSet,
+// taken from the end of the pod's name (or our hostname)
+func statefulSetOrdinal() (int, error) {
+	name := os.Getenv("POD_NAME")
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return 0, err
+		}
+		name = hostname
+	}
+
+	i := strings.LastIndex(name, "-")
+	ordinal, err := strconv.Atoi(name[i+1:])
+	if i < 0 || err != nil {
+		return 0, fmt.Errorf("unable to find a StatefulSet ordinal in %q", name)
+	}
+	return ordinal, nil
+}
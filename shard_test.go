@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestOwnsObject(t *testing.T) {
+	shards := 3
+	for _, key := range []string{shardByNamespace, shardByUID} {
+		t.Run(key, func(t *testing.T) {
+			counts := make([]int, shards)
+			for i := 0; i < 1000; i++ {
+				obj := newUnstructured("apps/v1", "Deployment", fmt.Sprintf("namespace-%d", i), "test", "1", emptyMap, emptyMap, false)
+				obj.SetUID(types.UID(fmt.Sprintf("uid-%d", i)))
+
+				// Every object should belong to exactly one shard
+				owners := 0
+				for index := 0; index < shards; index++ {
+					index := index
+					if ownsObject(shardingConfig{Shards: shards, Index: &index, Key: key}, obj) {
+						owners++
+						counts[index]++
+					}
+				}
+				require.Equal(t, 1, owners)
+			}
+
+			for index, count := range counts {
+				require.NotZero(t, count, "shard %d owns nothing", index)
+			}
+		})
+	}
+
+	t.Run("unsharded", func(t *testing.T) {
+		obj := newUnstructured("apps/v1", "Deployment", "test", "test", "1", emptyMap, emptyMap, false)
+		require.True(t, ownsObject(shardingConfig{}, obj))
+	})
+}
+
+func TestJumpHash(t *testing.T) {
+	// Growing the number of buckets should only ever move keys to the new bucket
+	for key := uint64(0); key < 1000; key++ {
+		before := jumpHash(key, 3)
+		after := jumpHash(key, 4)
+		require.True(t, after == before || after == 3, "key %d moved from %d to %d", key, before, after)
+	}
+}
+
+func TestStatefulSetOrdinal(t *testing.T) {
+	tests := map[string]struct {
+		podName string
+		want    int
+		wantErr bool
+	}{
+		"ordinal":    {podName: "kove-2", want: 2},
+		"hyphenated": {podName: "my-kove-10", want: 10},
+		"no ordinal": {podName: "kove-abcde", wantErr: true},
+		"no hyphen":  {podName: "kove", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("POD_NAME", tc.podName)
+			got, err := statefulSetOrdinal()
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
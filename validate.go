@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/loader"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery"
+)
+
+// validateCommand reports every problem with a config, exiting with exitViolations if
+// there are any. Objects are checked against discovery from the cluster, or a recording
+func validateCommand(args []string) int {
+	fs := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	path := fs.String("config", "", "Path to the configuration")
+	discoveryPath := fs.String("discovery", "", "Path to recorded discovery documents (APIResourceLists) to check objects against")
+	live := fs.Bool("live", false, "Check objects against discovery from the cluster")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kove validate-config [options]\n\nReports every problem with the config and its policies.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+
+	var resources []*metav1.APIResourceList
+	var err error
+	switch {
+	case *discoveryPath != "":
+		resources, err = readDiscovery(*discoveryPath)
+	case *live:
+		resources, err = liveDiscovery()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	// Problems decoding the config don't stop us checking what could be decoded of it
+	configPath = path
+	c, err := loadConfig()
+	problems := joinedErrors(err)
+	if c != nil {
+		problems = append(problems, validateConfig(context.Background(), c, resources)...)
+	}
+
+	for _, p := range problems {
+		fmt.Fprintf(os.Stdout, "- %v\n", p)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stdout, "%d problem(s) found\n", len(problems))
+		return exitViolations
+	}
+	fmt.Fprintln(os.Stdout, "config is valid")
+	return exitOK
+}
+
+// validateConfig checks what loading a config can't: that its policies exist and compile,
+// and that its queries refer to rules the policies define. Given discovery, it also
+// checks that the objects it refers to are served. Every problem found is returned
+func validateConfig(ctx context.Context, c *config, resources []*metav1.APIResourceList) []error {
+	var problems []error
+	for _, b := range c.Bundles {
+		missing := false
+		for _, p := range b.Policies {
+			if _, err := os.Stat(p); err != nil {
+				problems = append(problems, fmt.Errorf("bundle %q: policy path %q: %w", b.Name, p, err))
+				missing = true
+			}
+		}
+		if missing {
+			continue
+		}
+
+		// Queries are prepared directly, rather than through a policySet, so
+		// validating doesn't touch our policy metrics
+		compiled := true
+		for _, q := range b.Queries {
+			if _, err := prepareQuery(ctx, q.Query, b.Policies); err != nil {
+				problems = append(problems, fmt.Errorf("bundle %q query %q: %w", b.Name, q.Name, err))
+				compiled = false
+			}
+		}
+		if compiled {
+			problems = append(problems, validateQueries(b)...)
+		}
+	}
+
+	if resources != nil {
+		problems = append(problems, validateObjects(c, resources)...)
+	}
+	return problems
+}
+
+// validateQueries checks that every reference to data in a bundle's queries may refer
+// to a rule its policies define. Without policies, there's nothing to check against
+func validateQueries(b bundleConfig) []error {
+	if len(b.Policies) == 0 {
+		return nil
+	}
+
+	loaded, err := loader.NewFileLoader().Filtered(b.Policies, skipTestFiles)
+	if err != nil {
+		return []error{fmt.Errorf("bundle %q: %w", b.Name, err)}
+	}
+	compiler, err := loaded.Compiler()
+	if err != nil {
+		return []error{fmt.Errorf("bundle %q: %w", b.Name, err)}
+	}
+
+	var problems []error
+	for _, q := range b.Queries {
+		body, err := ast.ParseBody(q.Query)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("bundle %q query %q: %w", b.Name, q.Name, err))
+			continue
+		}
+		ast.WalkRefs(body, func(ref ast.Ref) bool {
+			if ref.HasPrefix(ast.DefaultRootRef) && len(compiler.GetRulesDynamicWithOpts(ref, ast.RulesOptions{})) == 0 {
+				problems = append(problems, fmt.Errorf("bundle %q query %q: %s is not defined by any policy", b.Name, q.Name, ref))
+			}
+			return false
+		})
+	}
+	return problems
+}
+
+// validateObjects checks that the objects we're configured to watch, and those bundles
+// are bound to, are served by the cluster
+func validateObjects(c *config, resources []*metav1.APIResourceList) []error {
+	served := make(map[schema.GroupVersionResource]bool)
+	for _, list := range resources {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		for _, r := range list.APIResources {
+			served[gv.WithResource(r.Name)] = true
+		}
+	}
+
+	var problems []error
+	for _, o := range c.Objects {
+		if !served[o.GroupVersionResource] {
+			problems = append(problems, fmt.Errorf("object %s is not served by the cluster", o.GroupVersionResource))
+		}
+	}
+	for _, b := range c.Bundles {
+		for _, gvr := range b.Objects {
+			if !served[gvr] {
+				problems = append(problems, fmt.Errorf("bundle %q: object %s is not served by the cluster", b.Name, gvr))
+			}
+		}
+	}
+	return problems
+}
+
+// readDiscovery reads recorded discovery documents, such as the output of
+// `kubectl get --raw /apis/apps/v1`, from a file of one or more of them
+func readDiscovery(path string) ([]*metav1.APIResourceList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read discovery: %w", err)
+	}
+	defer f.Close()
+
+	var resources []*metav1.APIResourceList
+	decoder := yaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		list := &metav1.APIResourceList{}
+		if err := decoder.Decode(list); err != nil {
+			if errors.Is(err, io.EOF) {
+				return resources, nil
+			}
+			return nil, fmt.Errorf("unable to read discovery: %w", err)
+		}
+		if list.GroupVersion != "" {
+			resources = append(resources, list)
+		}
+	}
+}
+
+// liveDiscovery returns the resources served by the cluster
+func liveDiscovery() ([]*metav1.APIResourceList, error) {
+	cfg, err := restConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve kube config: %w", err)
+	}
+	discover, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct discovery client: %w", err)
+	}
+
+	// Groups that can't be discovered don't stop us checking the rest
+	_, resources, err := discover.ServerGroupsAndResources()
+	if err != nil && len(resources) == 0 {
+		return nil, fmt.Errorf("unable to discover server-groups-and-resources: %w", err)
+	}
+	return resources, nil
+}
+
+// joinedErrors returns the errors joined into err, or err alone
+func joinedErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
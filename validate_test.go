@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestValidateConfig(t *testing.T) {
+	broken := filepath.Join(t.TempDir(), "broken.rego")
+	require.NoError(t, os.WriteFile(broken, []byte("package broken\n\nmain[x {\n"), 0o644))
+
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	resources := []*metav1.APIResourceList{{GroupVersion: "apps/v1", APIResources: []metav1.APIResource{{Name: "deployments"}}}}
+
+	tests := map[string]struct {
+		conf      config
+		resources []*metav1.APIResourceList
+		want      int
+	}{
+		"valid": {
+			conf: config{Bundles: []bundleConfig{{Name: "default", Policies: []string{"example/policies"}, Queries: []queryConfig{testQuery}}}},
+		},
+		"no policies": {
+			conf: config{Bundles: []bundleConfig{{Name: "default", Queries: []queryConfig{testQuery}}}},
+		},
+		"missing policies": {
+			conf: config{Bundles: []bundleConfig{{Name: "default", Policies: []string{"example/missing", "example/gone"}, Queries: []queryConfig{testQuery}}}},
+			want: 2,
+		},
+		"broken policies": {
+			conf: config{Bundles: []bundleConfig{{Name: "default", Policies: []string{broken}, Queries: []queryConfig{testQuery}}}},
+			want: 1,
+		},
+		"undefined queries": {
+			conf: config{Bundles: []bundleConfig{{Name: "default", Policies: []string{"example/policies"}, Queries: []queryConfig{
+				{Name: "defined", Query: "data.appchart_version.main"},
+				{Name: "undefined", Query: "data.appchart_version.missing"},
+				{Name: "undefined package", Query: "data[_].missing"},
+			}}}},
+			want: 2,
+		},
+		"served objects": {
+			conf:      config{Objects: []objectConfig{{GroupVersionResource: deployments}}},
+			resources: resources,
+		},
+		"unserved objects": {
+			conf: config{
+				Objects: []objectConfig{{GroupVersionResource: schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deploymentz"}}},
+				Bundles: []bundleConfig{{Name: "services", Objects: []schema.GroupVersionResource{{Version: "v1", Resource: "services"}}}},
+			},
+			resources: resources,
+			want:      2,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			loaded, compileErrors := testutil.ToFloat64(policiesLoaded), testutil.CollectAndCount(totalCompileErrors)
+			require.Len(t, validateConfig(context.Background(), &tc.conf, tc.resources), tc.want)
+
+			// Validating doesn't touch our policy metrics
+			require.Equal(t, loaded, testutil.ToFloat64(policiesLoaded))
+			require.Equal(t, compileErrors, testutil.CollectAndCount(totalCompileErrors))
+		})
+	}
+}
+
+func TestValidateConfigPartial(t *testing.T) {
+	defer initConfig()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("ignoreChildrens: true\npolicies:\n  - nope/\n"), 0o644))
+	configPath = &path
+
+	// The misspelt option doesn't stop the missing policies being found
+	c, err := loadConfig()
+	require.Len(t, joinedErrors(err), 1)
+	require.NotNil(t, c)
+
+	problems := validateConfig(context.Background(), c, nil)
+	require.Len(t, problems, 1)
+	require.ErrorContains(t, problems[0], "nope/")
+}
+
+func TestReadDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "discovery.json")
+	docs := `{"kind": "APIResourceList", "groupVersion": "apps/v1", "resources": [{"name": "deployments", "namespaced": true, "kind": "Deployment", "verbs": ["list"]}]}
+{"kind": "APIResourceList", "groupVersion": "v1", "resources": [{"name": "services", "namespaced": true, "kind": "Service", "verbs": ["list"]}]}`
+	require.NoError(t, os.WriteFile(path, []byte(docs), 0o644))
+
+	resources, err := readDiscovery(path)
+	require.NoError(t, err)
+	require.Len(t, resources, 2)
+	require.Equal(t, "deployments", resources[0].APIResources[0].Name)
+
+	_, err = readDiscovery(filepath.Join(t.TempDir(), "missing.json"))
+	require.Error(t, err)
+}
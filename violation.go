@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// violationSchema is the set of fields kove understands in policy output,
+// and whether policies must provide them
+var violationSchema = map[string]bool{
+	"Name":       true,
+	"Namespace":  true,
+	"Kind":       true,
+	"ApiVersion": true,
+	"RuleSet":    false,
+	"Data":       false,
+	"Severity":   false,
+	"Labels":     false,
+}
+
+// Reasons policy output may be rejected, used as the 'reason' label
+// of opa_policy_output_errors_total
+const (
+	reasonUnsupportedType = "unsupported_type"
+	reasonMissingField    = "missing_field"
+	reasonInvalidField    = "invalid_field"
+)
+
+// Violation is a single policy violation returned from evaluating an object
+type Violation struct {
+	Name       string
+	Namespace  string
+	Kind       string
+	ApiVersion string
+	RuleSet    string
+	Data       string
+	Severity   string
+
+	// Labels describing the violation, by sanitised label name.
+	// Those in our allow-list are exported as Prometheus labels
+	Labels map[string]string `json:",omitempty"`
+
+	// Any other fields returned by the policy
+	Extra map[string]interface{} `json:",omitempty"`
+}
+
+// outputError describes policy output that couldn't be decoded into a violation
+type outputError struct {
+	// The rule which produced the output
+	Policy string
+	Reason string
+	Output interface{}
+	Err    error
+}
+
+func (e *outputError) Error() string {
+	return fmt.Sprintf("policy %q: %v", e.Policy, e.Err)
+}
+
+func (e *outputError) Unwrap() error {
+	return e.Err
+}
+
+// decodeViolations converts the results of evaluating obj into violations.
+// Expressions may produce:
+//   - a set or array of violations
+//   - a single violation object
+//   - a set or array of strings, each describing a violation of obj
+//   - a boolean, where true describes a violation of obj
+//
+// Violations without a severity are given the default one.
+// Output that can't be decoded is returned as errors alongside any valid violations
+func decodeViolations(rs rego.ResultSet, obj *unstructured.Unstructured, sc severityConfig) ([]Violation, []*outputError) {
+	var violations []Violation
+	var errs []*outputError
+
+	for _, r := range rs {
+		for _, e := range r.Expressions {
+			policy := resultPolicy(r, e)
+
+			var items []interface{}
+			switch val := e.Value.(type) {
+			case []interface{}:
+				items = val
+			case map[string]interface{}:
+				items = []interface{}{val}
+			case bool:
+				if val {
+					violations = append(violations, objectViolation(obj, policy, sc.Default))
+				}
+				continue
+			default:
+				errs = append(errs, &outputError{
+					Policy: policy,
+					Reason: reasonUnsupportedType,
+					Output: e.Value,
+					Err:    fmt.Errorf("output is %T, expected a set, array, object or boolean", e.Value),
+				})
+				continue
+			}
+
+			for _, i := range items {
+				if s, ok := i.(string); ok {
+					violations = append(violations, objectViolation(obj, s, sc.Default))
+					continue
+				}
+
+				v, reason, err := newViolation(i, sc)
+				if err != nil {
+					errs = append(errs, &outputError{Policy: policy, Reason: reason, Output: i, Err: err})
+					continue
+				}
+				violations = append(violations, v)
+			}
+		}
+	}
+
+	return violations, errs
+}
+
+// resultPolicy returns the rule an expression's output came from, resolving the variables of
+// a reference to data with the result's bindings, so data[kove_pkg0].main becomes
+// data.deprecations.main. Expressions other than references are returned as written
+func resultPolicy(r rego.Result, e *rego.ExpressionValue) string {
+	ref, err := ast.ParseRef(e.Text)
+	if err != nil {
+		return e.Text
+	}
+
+	for i, t := range ref[1:] {
+		v, ok := t.Value.(ast.Var)
+		if !ok {
+			continue
+		}
+		if b, ok := r.Bindings[string(v)]; ok {
+			if val, err := ast.InterfaceToValue(b); err == nil {
+				ref[i+1] = ast.NewTerm(val)
+			}
+		}
+	}
+	return ref.String()
+}
+
+// objectViolation describes a violation of obj when the policy only tells us
+// that a violation occurred, rather than providing its details
+func objectViolation(obj *unstructured.Unstructured, ruleSet, severity string) Violation {
+	return Violation{
+		Name:       obj.GetName(),
+		Namespace:  obj.GetNamespace(),
+		Kind:       obj.GetKind(),
+		ApiVersion: obj.GetAPIVersion(),
+		RuleSet:    ruleSet,
+		Severity:   severity,
+	}
+}
+
+// newViolation validates a single item of policy output against our schema and
+// the severities we allow. On failure, the reason it was rejected is returned with the error
+func newViolation(i interface{}, sc severityConfig) (Violation, string, error) {
+	m, ok := i.(map[string]interface{})
+	if !ok {
+		return Violation{}, reasonUnsupportedType, fmt.Errorf("violation is %T, expected an object or string", i)
+	}
+
+	var missing []string
+	var labels map[string]string
+	fields := make(map[string]string)
+	for f, required := range violationSchema {
+		v, ok := m[f]
+		if !ok {
+			if required {
+				missing = append(missing, f)
+			}
+			continue
+		}
+
+		// Labels are free-form, so we accept any scalar values
+		if f == "Labels" {
+			var err error
+			if labels, err = outputLabels(v); err != nil {
+				return Violation{}, reasonInvalidField, fmt.Errorf("violation field %q: %w", f, err)
+			}
+			continue
+		}
+
+		// Data is free-form, so we accept any scalar value
+		if f == "Data" {
+			s, err := scalarString(v)
+			if err != nil {
+				return Violation{}, reasonInvalidField, fmt.Errorf("violation field %q: %w", f, err)
+			}
+			fields[f] = s
+			continue
+		}
+
+		s, ok := v.(string)
+		if !ok {
+			return Violation{}, reasonInvalidField, fmt.Errorf("violation field %q is %T, expected a string", f, v)
+		}
+		fields[f] = s
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return Violation{}, reasonMissingField, fmt.Errorf("violation is missing required fields %q", missing)
+	}
+
+	v := Violation{
+		Name:       fields["Name"],
+		Namespace:  fields["Namespace"],
+		Kind:       fields["Kind"],
+		ApiVersion: fields["ApiVersion"],
+		RuleSet:    fields["RuleSet"],
+		Data:       fields["Data"],
+		Severity:   fields["Severity"],
+		Labels:     labels,
+	}
+	if v.Severity == "" {
+		v.Severity = sc.Default
+	} else if !contains(sc.Levels, v.Severity) {
+		return Violation{}, reasonInvalidField, fmt.Errorf("violation severity %q is not one of %q", v.Severity, sc.Levels)
+	}
+	for k, val := range m {
+		if _, ok := violationSchema[k]; ok {
+			continue
+		}
+		if v.Extra == nil {
+			v.Extra = make(map[string]interface{})
+		}
+		v.Extra[k] = val
+	}
+
+	return v, "", nil
+}
+
+// outputLabels converts the labels of policy output to strings, by sanitised label name
+func outputLabels(v interface{}) (map[string]string, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("labels are %T, expected an object", v)
+	}
+
+	labels := make(map[string]string, len(m))
+	for k, val := range m {
+		s, err := scalarString(val)
+		if err != nil {
+			return nil, fmt.Errorf("label %q: %w", k, err)
+		}
+		labels[sanitizeLabelName(k)] = s
+	}
+	return labels, nil
+}
+
+// sanitizeLabelName converts a string to a valid Prometheus label name,
+// replacing invalid characters with underscores
+func sanitizeLabelName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
+
+// scalarString converts a scalar value from policy output to a string
+func scalarString(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return val, nil
+	case json.Number:
+		return val.String(), nil
+	case bool, int, int64, float64:
+		return fmt.Sprint(val), nil
+	default:
+		return "", fmt.Errorf("value is %T, expected a scalar", v)
+	}
+}
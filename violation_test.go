@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/open-policy-agent/opa/rego"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testSeverity = severityConfig{Default: "medium", Levels: []string{"critical", "high", "medium", "low", "info"}}
+
+func TestNewViolation(t *testing.T) {
+	tests := map[string]struct {
+		input   interface{}
+		want    Violation
+		wantErr bool
+	}{
+		"all fields": {
+			input: map[string]interface{}{"Name": "test", "Namespace": "default", "Kind": "Deployment", "ApiVersion": "apps/v1", "RuleSet": "bad", "Data": "team"},
+			want:  Violation{Name: "test", Namespace: "default", Kind: "Deployment", ApiVersion: "apps/v1", RuleSet: "bad", Data: "team", Severity: "medium"},
+		},
+		"optional fields omitted": {
+			input: map[string]interface{}{"Name": "test", "Namespace": "", "Kind": "Namespace", "ApiVersion": "v1"},
+			want:  Violation{Name: "test", Kind: "Namespace", ApiVersion: "v1", Severity: "medium"},
+		},
+		"extra fields": {
+			input: map[string]interface{}{"Name": "test", "Namespace": "default", "Kind": "Deployment", "ApiVersion": "apps/v1", "Owner": "team"},
+			want:  Violation{Name: "test", Namespace: "default", Kind: "Deployment", ApiVersion: "apps/v1", Severity: "medium", Extra: map[string]interface{}{"Owner": "team"}},
+		},
+		"severity": {
+			input: map[string]interface{}{"Name": "test", "Namespace": "default", "Kind": "Deployment", "ApiVersion": "apps/v1", "Severity": "critical"},
+			want:  Violation{Name: "test", Namespace: "default", Kind: "Deployment", ApiVersion: "apps/v1", Severity: "critical"},
+		},
+		"unknown severity": {
+			input:   map[string]interface{}{"Name": "test", "Namespace": "default", "Kind": "Deployment", "ApiVersion": "apps/v1", "Severity": "dire"},
+			wantErr: true,
+		},
+		"labels": {
+			input: map[string]interface{}{"Name": "test", "Namespace": "default", "Kind": "Deployment", "ApiVersion": "apps/v1", "Labels": map[string]interface{}{"team": "payments", "cost-centre": json.Number("42")}},
+			want:  Violation{Name: "test", Namespace: "default", Kind: "Deployment", ApiVersion: "apps/v1", Severity: "medium", Labels: map[string]string{"team": "payments", "cost_centre": "42"}},
+		},
+		"non-scalar label": {
+			input:   map[string]interface{}{"Name": "test", "Namespace": "default", "Kind": "Deployment", "ApiVersion": "apps/v1", "Labels": map[string]interface{}{"team": []interface{}{"a"}}},
+			wantErr: true,
+		},
+		"missing required field": {
+			input:   map[string]interface{}{"Name": "test", "Kind": "Deployment", "ApiVersion": "apps/v1"},
+			wantErr: true,
+		},
+		"scalar data": {
+			input: map[string]interface{}{"Name": "test", "Namespace": "default", "Kind": "Deployment", "ApiVersion": "apps/v1", "Data": json.Number("3")},
+			want:  Violation{Name: "test", Namespace: "default", Kind: "Deployment", ApiVersion: "apps/v1", Data: "3", Severity: "medium"},
+		},
+		"non-scalar data": {
+			input:   map[string]interface{}{"Name": "test", "Namespace": "default", "Kind": "Deployment", "ApiVersion": "apps/v1", "Data": []interface{}{"a"}},
+			wantErr: true,
+		},
+		"wrong field type": {
+			input:   map[string]interface{}{"Name": 1, "Namespace": "default", "Kind": "Deployment", "ApiVersion": "apps/v1"},
+			wantErr: true,
+		},
+		"not an object": {
+			input:   1,
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, _, err := newViolation(tc.input, testSeverity)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestDecodeViolations(t *testing.T) {
+	obj := newUnstructured("apps/v1", "Deployment", "default", "test", "1", emptyMap, emptyMap, false)
+	objViolation := func(ruleSet string) Violation {
+		return Violation{Name: "test", Namespace: "default", Kind: "Deployment", ApiVersion: "apps/v1", RuleSet: ruleSet, Severity: "medium"}
+	}
+
+	tests := map[string]struct {
+		value      interface{}
+		want       []Violation
+		wantReason string
+	}{
+		"set of objects": {
+			value: []interface{}{map[string]interface{}{"Name": "test", "Namespace": "default", "Kind": "Deployment", "ApiVersion": "apps/v1", "RuleSet": "bad"}},
+			want:  []Violation{objViolation("bad")},
+		},
+		"single object": {
+			value: map[string]interface{}{"Name": "test", "Namespace": "default", "Kind": "Deployment", "ApiVersion": "apps/v1", "RuleSet": "bad"},
+			want:  []Violation{objViolation("bad")},
+		},
+		"set of strings": {
+			value: []interface{}{"first", "second"},
+			want:  []Violation{objViolation("first"), objViolation("second")},
+		},
+		"true": {
+			value: true,
+			want:  []Violation{objViolation("data.test.deny")},
+		},
+		"false": {
+			value: false,
+		},
+		"number": {
+			value:      json.Number("1"),
+			wantReason: reasonUnsupportedType,
+		},
+		"missing fields": {
+			value:      []interface{}{map[string]interface{}{"RuleSet": "bad"}},
+			wantReason: reasonMissingField,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rs := rego.ResultSet{{Expressions: []*rego.ExpressionValue{{Value: tc.value, Text: "data.test.deny"}}}}
+			got, errs := decodeViolations(rs, obj, testSeverity)
+			require.Equal(t, tc.want, got)
+			if tc.wantReason == "" {
+				require.Empty(t, errs)
+				return
+			}
+			require.Len(t, errs, 1)
+			require.Equal(t, tc.wantReason, errs[0].Reason)
+		})
+	}
+}
+
+func TestDecodeViolationsPolicy(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	for _, pkg := range []string{"first", "second"} {
+		policy := fmt.Sprintf("package %s\n\nmain = 1\n", pkg)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, pkg+".rego"), []byte(policy), 0o644))
+	}
+
+	p := newPolicyEngine()
+	_, err := p.compile(ctx, "data[_].main", []string{dir})
+	require.NoError(t, err)
+	rs, err := p.eval(ctx, map[string]interface{}{})
+	require.NoError(t, err)
+
+	// Errors point at the rule of each package, rather than the query
+	obj := newUnstructured("apps/v1", "Deployment", "default", "test", "1", emptyMap, emptyMap, false)
+	_, errs := decodeViolations(rs, obj, testSeverity)
+	var policies []string
+	for _, e := range errs {
+		policies = append(policies, e.Policy)
+	}
+	require.ElementsMatch(t, []string{"data.first.main", "data.second.main"}, policies)
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	tests := map[string]string{
+		"team":                   "team",
+		"cost-centre":            "cost_centre",
+		"app.kubernetes.io/name": "app_kubernetes_io_name",
+		"2fa":                    "_fa",
+		"":                       "_",
+		"env_1":                  "env_1",
+	}
+
+	for input, want := range tests {
+		t.Run(input, func(t *testing.T) {
+			require.Equal(t, want, sanitizeLabelName(input))
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	klog "k8s.io/klog/v2"
+)
+
+// watcher calls onChange when any of the files or directories it's been told to
+// watch change on disk. Files are watched through their parent directory, which
+// allows us to catch the '..data' symlink swap Kubernetes performs when a mounted
+// ConfigMap is updated. Bursts of events are collapsed into a single call
+type watcher struct {
+	fsw      *fsnotify.Watcher
+	debounce time.Duration
+	onChange func()
+
+	mu   sync.Mutex
+	dirs map[string]struct{}
+}
+
+// newWatcher returns a watcher that calls onChange once changes have settled
+// for the given debounce period
+func newWatcher(debounce time.Duration, onChange func()) (*watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	return &watcher{
+		fsw:      fsw,
+		debounce: debounce,
+		onChange: onChange,
+		dirs:     make(map[string]struct{}),
+	}, nil
+}
+
+// watch replaces the set of watched paths
+func (w *watcher) watch(paths []string) error {
+	dirs := make(map[string]struct{})
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			dirs[filepath.Dir(path)] = struct{}{}
+			continue
+		}
+
+		// Policies may be nested, so watch every directory beneath this one
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				dirs[p] = struct{}{}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for dir := range w.dirs {
+		if _, ok := dirs[dir]; !ok {
+			w.fsw.Remove(dir)
+		}
+	}
+	for dir := range dirs {
+		if err := w.fsw.Add(dir); err != nil {
+			return err
+		}
+	}
+	w.dirs = dirs
+
+	return nil
+}
+
+// run processes filesystem events until the stop channel is closed
+func (w *watcher) run(stopCh <-chan struct{}) {
+	defer w.fsw.Close()
+
+	var timer *time.Timer
+	for {
+		select {
+		case <-stopCh:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case event, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if timer == nil {
+				timer = time.AfterFunc(w.debounce, w.onChange)
+			} else {
+				timer.Reset(w.debounce)
+			}
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			klog.ErrorS(err, "error watching config and policies")
+		}
+	}
+}
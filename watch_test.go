@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestWatcherConfigMapSwap mimics the way the kubelet updates a mounted ConfigMap:
+// files are symlinks through '..data', which is atomically swapped to a new directory
+func TestWatcherConfigMapSwap(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "..v1"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "..v1", "policy.rego"), []byte("package v1"), 0o644))
+	require.NoError(t, os.Symlink("..v1", filepath.Join(dir, "..data")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "policy.rego"), filepath.Join(dir, "policy.rego")))
+
+	changed := make(chan struct{}, 1)
+	w, err := newWatcher(10*time.Millisecond, func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	require.NoError(t, err)
+	require.NoError(t, w.watch([]string{dir}))
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go w.run(stopCh)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "..v2"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "..v2", "policy.rego"), []byte("package v2"), 0o644))
+	require.NoError(t, os.Symlink("..v2", filepath.Join(dir, "..data_tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change observed after '..data' swap")
+	}
+}